@@ -5,13 +5,30 @@ import (
 	"github.com/skycoin/cxo/bbs"
 	"github.com/skycoin/cxo/data"
 	"github.com/skycoin/cxo/nodeManager"
-	// "github.com/skycoin/cxo/skyobject"
+	"github.com/skycoin/cxo/skyobject"
 	"github.com/skycoin/skycoin/src/cipher"
 	"github.com/skycoin/skycoin/src/cipher/encoder"
 	// "strings"
 	// "errors"
 )
 
+// rawGetter is the part of the Container this file needs:
+// a single-object lookup by hash. containerGetter adapts it
+// to skyobject.Getter so the DAGService can batch requests
+// for it the same way it would batch requests over a
+// node.Conn
+type rawGetter interface {
+	GetRaw(key cipher.SHA256) (val []byte, err error)
+}
+
+type containerGetter struct {
+	c rawGetter
+}
+
+func (g containerGetter) Get(key cipher.SHA256) (val []byte, err error) {
+	return g.c.GetRaw(key)
+}
+
 type BBSIndexer struct {
 	BBS *bbs.Bbs
 
@@ -110,14 +127,21 @@ func (bi *BBSIndexer) GetThreadsFromBoard(boardName string) (threads []bbs.Threa
 		return
 	}
 
-	// Get Threads from Board.
+	// Get Threads from Board. Rather than walking the Thread
+	// HArray one hash at a time (GetMap), submit every child
+	// hash to the DAGService as a single batch so a board with
+	// thousands of threads fetches them concurrently
 	typ, data := c.GetObject(key)
 	threadArrayKey := c.GetField(typ, data, "Threads")
-	threadMap := c.GetMap(threadArrayKey, "Thread")
+	hashes := c.GetHashes(threadArrayKey)
 
-	for _, threadData := range threadMap {
+	ds := skyobject.NewDAGService(containerGetter{c})
+	for no := range ds.GetMany(hashes) {
+		if no.Err != nil {
+			continue // skip objects we failed to fetch
+		}
 		var thread bbs.Thread
-		encoder.DeserializeRaw(threadData, &thread)
+		encoder.DeserializeRaw(no.Node, &thread)
 		threads = append(threads, thread)
 	}
 
@@ -141,14 +165,19 @@ func (bi *BBSIndexer) GetPostsFromThread(threadName string) (posts []bbs.Post, e
 		return
 	}
 
-	// Get Posts from Thread.
+	// Get Posts from Thread, batched through the DAGService
+	// for the same reason as GetThreadsFromBoard above
 	typ, data := c.GetObject(key)
 	postArrayKey := c.GetField(typ, data, "Posts")
-	postMap := c.GetMap(postArrayKey, "Post")
+	hashes := c.GetHashes(postArrayKey)
 
-	for _, postData := range postMap {
+	ds := skyobject.NewDAGService(containerGetter{c})
+	for no := range ds.GetMany(hashes) {
+		if no.Err != nil {
+			continue // skip objects we failed to fetch
+		}
 		var post bbs.Post
-		encoder.DeserializeRaw(postData, &post)
+		encoder.DeserializeRaw(no.Node, &post)
 		posts = append(posts, post)
 	}
 
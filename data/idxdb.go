@@ -2,6 +2,8 @@ package data
 
 import (
 	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/skycoin/cxo/data/wal"
 )
 
 // An IterateFeedsFunc represents function for
@@ -128,5 +130,24 @@ type IdxDB interface {
 
 	IsClosedSafely() bool // true if DB is ok
 
-	// TODO: stat
+	// Recover replays the write-ahead log left behind by an
+	// unsafe closing, calling yield for every wal.Record the
+	// log holds, from the first one on; checkpoints do not
+	// shorten the replay. It is a no-op (returns nil
+	// without calling yield) if IsClosedSafely reports true.
+	// Implementations that don't keep a WAL may just return
+	// nil always
+	Recover(yield func(r *wal.Record) error) (err error)
+
+	// Stat returns the current feed/head/Root counts, used by
+	// DB.Stat to fill in the corresponding fields of Stat
+	Stat() (st IdxDBStat, err error)
+}
+
+// An IdxDBStat is a snapshot of the feed/head/Root counts
+// kept by an IdxDB
+type IdxDBStat struct {
+	Feeds int // number of feeds
+	Heads int // total heads across all feeds
+	Roots int // total Root objects across all heads
 }
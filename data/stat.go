@@ -0,0 +1,15 @@
+package data
+
+// A Stat is a snapshot of a DB: the feed/head/Root shape kept
+// by its IdxDB plus the object counts and sizes kept by its
+// CXDS. It's returned by DB.Stat and composed into the Data
+// field of node.Stat by Node.Stat
+type Stat struct {
+	IdxDBStat // feed/head/Root counts
+
+	Objects    int   // total objects held by the CXDS
+	TotalBytes int64 // total size in bytes of all CXDS values
+
+	AvgRefsCount float64 // average refcount across CXDS objects
+	MaxRefsCount uint32  // highest refcount seen
+}
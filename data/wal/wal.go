@@ -0,0 +1,347 @@
+// Package wal implements a compact append-only write-ahead
+// log for data/idxdb, so a crash doesn't force the
+// skyobject cache to walk every feed/head/root to reconcile
+// CXDS refcounts. Every mutating Feeds/Heads/Roots method
+// inside a Tx writes one framed Record here before the
+// underlying bolt/badger transaction commits; on a clean
+// Close the log is truncated, and on an unclean restart
+// IdxDB.Recover replays the log's records instead of scanning
+// the whole DB. A checkpoint fsyncs the log; it neither
+// rotates the file nor records a position, so Recover replays
+// every record the log holds
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// Op is the kind of mutation a Record represents
+type Op byte
+
+// known ops
+const (
+	OpAddFeed Op = 1 + iota
+	OpDelFeed
+	OpAddHead
+	OpDelHead
+	OpSetRoot
+	OpDelRoot
+)
+
+// A Record is one WAL entry: enough to redo a single
+// mutating Feeds/Heads/Roots call without touching the rest
+// of the DB. ReqNum is a monotonically increasing number
+// stamped on every record; Replay's from argument skips the
+// records below a given ReqNum
+type Record struct {
+	ReqNum uint64
+
+	Op Op
+
+	Feed  cipher.PubKey
+	Nonce uint64
+	Seq   uint64
+
+	RootHash cipher.SHA256
+
+	// RefDelta is the refcount adjustment this mutation
+	// implies for RootHash's objects (+1 on OpSetRoot,
+	// -1 on OpDelRoot, 0 otherwise)
+	RefDelta int64
+}
+
+// wire layout: fixed-size fields back to back, no framing
+// length needed since every Record encodes to the same size
+const recordSize = 8 + 1 + 33 + 8 + 8 + 32 + 8
+
+func (r *Record) encode() (raw []byte) {
+	raw = make([]byte, recordSize)
+
+	var off int
+
+	binary.LittleEndian.PutUint64(raw[off:], r.ReqNum)
+	off += 8
+
+	raw[off] = byte(r.Op)
+	off++
+
+	off += copy(raw[off:], r.Feed[:])
+
+	binary.LittleEndian.PutUint64(raw[off:], r.Nonce)
+	off += 8
+
+	binary.LittleEndian.PutUint64(raw[off:], r.Seq)
+	off += 8
+
+	off += copy(raw[off:], r.RootHash[:])
+
+	binary.LittleEndian.PutUint64(raw[off:], uint64(r.RefDelta))
+	off += 8
+
+	return
+}
+
+func decodeRecord(raw []byte) (r *Record, err error) {
+	if len(raw) != recordSize {
+		return nil, errors.New("wal: corrupt record: wrong size")
+	}
+
+	r = new(Record)
+
+	var off int
+
+	r.ReqNum = binary.LittleEndian.Uint64(raw[off:])
+	off += 8
+
+	r.Op = Op(raw[off])
+	off++
+
+	off += copy(r.Feed[:], raw[off:])
+
+	r.Nonce = binary.LittleEndian.Uint64(raw[off:])
+	off += 8
+
+	r.Seq = binary.LittleEndian.Uint64(raw[off:])
+	off += 8
+
+	off += copy(r.RootHash[:], raw[off:])
+
+	r.RefDelta = int64(binary.LittleEndian.Uint64(raw[off:]))
+	off += 8
+
+	return
+}
+
+// A WAL is an append-only log of Records backed by a single
+// file. It is safe for concurrent use
+type WAL struct {
+	path string
+
+	mx     sync.Mutex
+	file   *os.File
+	w      *bufio.Writer
+	reqNum uint64
+
+	// checkpointing
+	every    int // checkpoint after this many records
+	period   time.Duration
+	since    int
+	lastSync time.Time
+
+	quit chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+// Open opens (creating if needed) the WAL file at path.
+// every and period configure periodic checkpointing: the log
+// is fsynced and the in-memory counters reset after every
+// records are written or period elapses, whichever comes
+// first. Zero either disables that trigger
+func Open(path string, every int, period time.Duration) (w *WAL, err error) {
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+
+	w = new(WAL)
+	w.path = path
+	w.file = f
+	w.w = bufio.NewWriter(f)
+	w.every = every
+	w.period = period
+	w.lastSync = time.Now()
+	w.quit = make(chan struct{})
+
+	if info, serr := f.Stat(); serr == nil {
+		w.reqNum = uint64(info.Size() / recordSize)
+	}
+
+	if period > 0 {
+		w.wg.Add(1)
+		go w.checkpointLoop()
+	}
+
+	return
+}
+
+// Path returns the file path the WAL was opened with, so
+// callers that only hold a *WAL (e.g. an IdxDB decorator
+// implementing Recover) can pass it to Replay
+func (w *WAL) Path() string {
+	return w.path
+}
+
+// Lag returns how many records have been written since the
+// last checkpoint, for reporting (e.g. a WALLag gauge)
+func (w *WAL) Lag() int {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.since
+}
+
+// Append writes a Record to the log, stamping it with the
+// next ReqNum, and checkpoints if the record-count trigger
+// has been reached. It does not itself fsync unless a
+// checkpoint is due; callers that need durability of a
+// single record before replying to a caller should call
+// Checkpoint explicitly
+func (w *WAL) Append(r Record) (reqNum uint64, err error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	w.reqNum++
+	r.ReqNum = w.reqNum
+	reqNum = w.reqNum
+
+	if _, err = w.w.Write(r.encode()); err != nil {
+		return
+	}
+
+	w.since++
+	if w.every > 0 && w.since >= w.every {
+		err = w.checkpointLocked()
+	}
+
+	return
+}
+
+// Checkpoint flushes buffered writes, fsyncs the file, and
+// resets the since-last-checkpoint counters
+func (w *WAL) Checkpoint() (err error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.checkpointLocked()
+}
+
+func (w *WAL) checkpointLocked() (err error) {
+	if err = w.w.Flush(); err != nil {
+		return
+	}
+	if err = w.file.Sync(); err != nil {
+		return
+	}
+	w.since = 0
+	w.lastSync = time.Now()
+	return
+}
+
+func (w *WAL) checkpointLoop() {
+	defer w.wg.Done()
+
+	tk := time.NewTicker(w.period)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-tk.C:
+			w.Checkpoint()
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// Truncate empties the log. Call it after a clean Close of
+// the owning IdxDB, once all records have been applied to
+// the bolt/badger transaction they guarded
+func (w *WAL) Truncate() (err error) {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err = w.w.Flush(); err != nil {
+		return
+	}
+	if err = w.file.Truncate(0); err != nil {
+		return
+	}
+	if _, err = w.file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	w.w.Reset(w.file)
+	w.reqNum = 0
+	w.since = 0
+	return
+}
+
+// Close stops checkpointing and closes the underlying file.
+// It does not Truncate: callers decide whether the close was
+// clean
+func (w *WAL) Close() (err error) {
+	w.once.Do(func() { close(w.quit) })
+	w.wg.Wait()
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+
+	if err = w.w.Flush(); err != nil {
+		return
+	}
+	return w.file.Close()
+}
+
+// YieldFunc is called by Replay for every Record from >=
+// the requested starting point, in order. Returning an error
+// stops the replay and the error is passed through
+type YieldFunc func(r *Record) error
+
+// Replay reads the WAL at path from the first record whose
+// ReqNum is >= from, calling yield for each. stop, if
+// non-nil, lets the caller abort partway (e.g. on a timeout
+// or Node shutdown) without reading the rest of a possibly
+// large log. A crash mid-Append can leave a final record
+// shorter than recordSize; io.ReadFull reports that as
+// io.ErrUnexpectedEOF rather than io.EOF, and Replay treats it
+// the same way (stop, don't error) since every earlier record
+// is still intact and usable
+func Replay(path string, from uint64, stop <-chan struct{}, yield YieldFunc) (err error) {
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil // nothing to replay
+	}
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	buf := make([]byte, recordSize)
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		if _, err = io.ReadFull(r, buf); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			}
+			return
+		}
+
+		rec, derr := decodeRecord(buf)
+		if derr != nil {
+			return derr
+		}
+
+		if rec.ReqNum < from {
+			continue
+		}
+
+		if err = yield(rec); err != nil {
+			return
+		}
+	}
+}
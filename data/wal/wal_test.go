@@ -0,0 +1,157 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// TestAppendReplayRoundTrip checks the core contract the
+// data.WALIdxDB integration depends on: every Record passed to
+// Append comes back out of Replay, in order, with its ReqNum
+// filled in
+func TestAppendReplayRoundTrip(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	w, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pk cipher.PubKey
+	pk[0] = 0xab
+
+	want := []Record{
+		{Op: OpAddFeed, Feed: pk},
+		{Op: OpAddHead, Feed: pk, Nonce: 1},
+		{Op: OpSetRoot, Feed: pk, Nonce: 1, Seq: 1, RefDelta: 1},
+	}
+
+	for i := range want {
+		reqNum, err := w.Append(want[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reqNum != uint64(i+1) {
+			t.Fatalf("reqNum %d, want %d", reqNum, i+1)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []Record
+	err = Replay(path, 0, nil, func(r *Record) error {
+		got = append(got, *r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if got[i].Op != want[i].Op || got[i].Feed != want[i].Feed ||
+			got[i].Nonce != want[i].Nonce || got[i].Seq != want[i].Seq ||
+			got[i].RefDelta != want[i].RefDelta {
+			t.Fatalf("record %d mismatch: got %+v, want %+v", i, got[i], want[i])
+		}
+		if got[i].ReqNum != uint64(i+1) {
+			t.Fatalf("record %d ReqNum = %d, want %d", i, got[i].ReqNum, i+1)
+		}
+	}
+}
+
+// TestReplayFrom checks that Replay(from) skips every Record
+// with ReqNum below from, so a caller that knows a ReqNum can
+// resume from it instead of replaying the whole log
+func TestReplayFrom(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	w, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := w.Append(Record{Op: OpAddFeed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reqNums []uint64
+	err = Replay(path, 4, nil, func(r *Record) error {
+		reqNums = append(reqNums, r.ReqNum)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(reqNums) != 2 || reqNums[0] != 4 || reqNums[1] != 5 {
+		t.Fatalf("got %v, want [4 5]", reqNums)
+	}
+}
+
+// TestReplayTornLastRecord checks that a log truncated
+// mid-Append (as a crash right after the bufio.Writer flushed
+// part of the last record would leave it) stops cleanly at the
+// last intact record instead of erroring out, the way a clean
+// io.EOF already does
+func TestReplayTornLastRecord(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "test.wal")
+
+	w, err := Open(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := w.Append(Record{Op: OpAddFeed}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash partway through appending a fourth
+	// record: a few extra bytes, short of recordSize
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, recordSize/2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var reqNums []uint64
+	err = Replay(path, 0, nil, func(r *Record) error {
+		reqNums = append(reqNums, r.ReqNum)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay should tolerate a torn last record, got err: %v", err)
+	}
+
+	if len(reqNums) != 3 || reqNums[0] != 1 || reqNums[2] != 3 {
+		t.Fatalf("got %v, want [1 2 3]", reqNums)
+	}
+}
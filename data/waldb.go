@@ -0,0 +1,210 @@
+package data
+
+import (
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/skycoin/cxo/data/wal"
+)
+
+// A WALIdxDB wraps an IdxDB so every mutating Feeds/Heads/Roots
+// call made inside a Tx is staged as a wal.Record and, once fn
+// returns nil and the wrapped Tx is therefore about to commit,
+// the staged records are appended to the write-ahead log in
+// order before Tx returns. Recover replays whatever the log
+// holds after an unsafe close. It's a decorator: all
+// non-mutating and lifecycle methods fall through to the
+// wrapped IdxDB via embedding, except where overridden below
+type WALIdxDB struct {
+	IdxDB
+
+	wal *wal.WAL
+}
+
+// NewWALIdxDB opens the WAL at walPath and returns idx wrapped
+// with it. every/period configure the WAL's checkpoint
+// triggers, see wal.Open
+func NewWALIdxDB(idx IdxDB, walPath string, every int, period time.Duration) (w *WALIdxDB, err error) {
+
+	lg, err := wal.Open(walPath, every, period)
+	if err != nil {
+		return
+	}
+
+	w = &WALIdxDB{IdxDB: idx, wal: lg}
+	return
+}
+
+// Tx wraps fs in a walFeeds backed by a fresh txLog before
+// calling fn, so every mutating call fn makes (directly on the
+// Feeds, or on a Heads/Roots reached through it) is staged
+// rather than written straight to the log. A record staged for
+// a call that fails inside fn never reaches the log: if every
+// record were written as soon as its call
+// happened, a failure partway through fn would leave the WAL
+// holding records for mutations the underlying bolt/badger Tx
+// never committed, and Recover would redo refcount adjustments
+// that don't correspond to anything in the DB. So the staged
+// records are only appended, in order, once fn has returned
+// nil, still inside the wrapped Tx and so before it commits;
+// an error appending them is returned from the wrapped Tx's
+// function, so that Tx does not commit
+func (w *WALIdxDB) Tx(fn func(Feeds) error) (err error) {
+	lg := new(txLog)
+
+	return w.IdxDB.Tx(func(fs Feeds) error {
+		if err := fn(&walFeeds{fs, lg}); err != nil {
+			return err
+		}
+		return lg.flush(w.wal)
+	})
+}
+
+// Recover replays the WAL from the beginning, calling yield
+// for every Record found, unless the wrapped IdxDB reports it
+// was closed safely last time, in which case there is nothing
+// to recover and Recover is a no-op
+func (w *WALIdxDB) Recover(yield func(r *wal.Record) error) (err error) {
+	if w.IsClosedSafely() {
+		return nil
+	}
+	return wal.Replay(w.wal.Path(), 0, nil, yield)
+}
+
+// Close closes the wrapped IdxDB, then truncates the WAL if
+// the IdxDB closed safely (the log is no longer needed), and
+// closes the WAL either way (an unsafe close leaves its
+// records for the next Recover)
+func (w *WALIdxDB) Close() (err error) {
+	if err = w.IdxDB.Close(); err != nil {
+		return
+	}
+	if w.IsClosedSafely() {
+		if err = w.wal.Truncate(); err != nil {
+			return
+		}
+	}
+	return w.wal.Close()
+}
+
+// WALLag returns how many WAL records have been written since
+// the last checkpoint
+func (w *WALIdxDB) WALLag() int {
+	return w.wal.Lag()
+}
+
+// a txLog buffers the wal.Records staged by one WALIdxDB.Tx
+// call, so they can be appended to the real log only once the
+// wrapped Tx's fn has succeeded
+type txLog struct {
+	pending []wal.Record
+}
+
+func (lg *txLog) stage(r wal.Record) {
+	lg.pending = append(lg.pending, r)
+}
+
+// flush appends every staged record to w in order, stopping at
+// the first error
+func (lg *txLog) flush(w *wal.WAL) (err error) {
+	for _, r := range lg.pending {
+		if _, err = w.Append(r); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// walFeeds stages a wal.Record for every mutating Feeds call,
+// and wraps the Heads it returns so nested Heads/Roots
+// mutations are staged too
+type walFeeds struct {
+	Feeds
+	log *txLog
+}
+
+func (f *walFeeds) Add(pk cipher.PubKey) (err error) {
+	f.log.stage(wal.Record{Op: wal.OpAddFeed, Feed: pk})
+	return f.Feeds.Add(pk)
+}
+
+func (f *walFeeds) Del(pk cipher.PubKey) (err error) {
+	f.log.stage(wal.Record{Op: wal.OpDelFeed, Feed: pk})
+	return f.Feeds.Del(pk)
+}
+
+func (f *walFeeds) Heads(pk cipher.PubKey) (hs Heads, err error) {
+	hs, err = f.Feeds.Heads(pk)
+	if err != nil {
+		return
+	}
+	return &walHeads{hs, f.log, pk}, nil
+}
+
+// walHeads stages a wal.Record for every mutating Heads call,
+// and wraps the Roots it returns the same way walFeeds wraps
+// Heads
+type walHeads struct {
+	Heads
+	log  *txLog
+	feed cipher.PubKey
+}
+
+func (h *walHeads) Add(nonce uint64) (rs Roots, err error) {
+	h.log.stage(wal.Record{
+		Op: wal.OpAddHead, Feed: h.feed, Nonce: nonce,
+	})
+	rs, err = h.Heads.Add(nonce)
+	if err != nil {
+		return
+	}
+	return &walRoots{rs, h.log, h.feed, nonce}, nil
+}
+
+func (h *walHeads) Del(nonce uint64) (err error) {
+	h.log.stage(wal.Record{
+		Op: wal.OpDelHead, Feed: h.feed, Nonce: nonce,
+	})
+	return h.Heads.Del(nonce)
+}
+
+func (h *walHeads) Roots(nonce uint64) (rs Roots, err error) {
+	rs, err = h.Heads.Roots(nonce)
+	if err != nil {
+		return
+	}
+	return &walRoots{rs, h.log, h.feed, nonce}, nil
+}
+
+// walRoots stages a wal.Record for every mutating Roots call,
+// the innermost wrapper in the walFeeds/walHeads/walRoots chain
+type walRoots struct {
+	Roots
+	log   *txLog
+	feed  cipher.PubKey
+	nonce uint64
+}
+
+func (r *walRoots) Set(root *Root) (err error) {
+	r.log.stage(wal.Record{
+		Op:       wal.OpSetRoot,
+		Feed:     r.feed,
+		Nonce:    r.nonce,
+		Seq:      root.Seq,
+		RootHash: root.Hash,
+		RefDelta: 1,
+	})
+	return r.Roots.Set(root)
+}
+
+func (r *walRoots) Del(seq uint64) (err error) {
+	r.log.stage(wal.Record{
+		Op:       wal.OpDelRoot,
+		Feed:     r.feed,
+		Nonce:    r.nonce,
+		Seq:      seq,
+		RefDelta: -1,
+	})
+	return r.Roots.Del(seq)
+}
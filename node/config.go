@@ -0,0 +1,132 @@
+package node
+
+import (
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/skycoin/cxo/data"
+	"github.com/skycoin/cxo/node/gnet"
+	"github.com/skycoin/cxo/node/log"
+	"github.com/skycoin/cxo/skyobject"
+)
+
+// defaults
+const (
+	DefaultResponseTimeout = 53 * time.Second // default ResponseTimeout
+
+	// DefaultWALCheckpointRecords is the default for
+	// Config.WALCheckpointRecords
+	DefaultWALCheckpointRecords = 1000
+	// DefaultWALCheckpointPeriod is the default for
+	// Config.WALCheckpointPeriod
+	DefaultWALCheckpointPeriod = 5 * time.Second
+
+	// DefaultWantlistDelay is the default for
+	// Config.WantlistDelay
+	DefaultWantlistDelay = 10 * time.Millisecond
+)
+
+// A Config represents configurations of a Node
+type Config struct {
+	gnet.Config // underlying connections pool
+
+	DataDir    string   // directory for DB files and peers.json
+	DB         *data.DB // use given DB instead of creating one
+	InMemoryDB bool     // use in-memory DB
+	DBPath     string   // custom DB files prefix
+
+	Skyobject skyobject.Config // configurations of the Container
+	Log       log.Config       // configurations of the Logger
+
+	EnableRPC  bool   // enable RPC server
+	RPCAddress string // RPC listening address
+
+	PublicServer bool // announce feeds via service discovery
+
+	// ResponseTimeout used for request-response calls such
+	// as RemoteFeeds, Preview and object requests. Zero or
+	// negative value means "no timeout"
+	ResponseTimeout time.Duration
+
+	// Public, if true, allows other peers to request the
+	// list of feeds this Node shares using RqList
+	Public bool
+
+	DiscoveryAddresses Addresses // messenger discovery servers
+
+	// StaticPublicKey/StaticSecretKey identify this Node to
+	// peers during the authenticated handshake (see
+	// handshake.go). If StaticSecretKey is unset, a fresh
+	// keypair is generated for the lifetime of the process
+	StaticPublicKey cipher.PubKey
+	StaticSecretKey cipher.SecKey
+
+	// DisableHandshake skips the authenticated RLPx-style
+	// handshake and falls back to the historical plaintext
+	// peerID exchange. Only meant for talking to peers that
+	// have not migrated yet; PeerID can't be trusted while
+	// this is set
+	DisableHandshake bool
+
+	// RqObjectRate and RqObjectBurst configure the per-
+	// connection token-bucket limiter in front of
+	// handleRqObject: RqObjectRate requests are allowed per
+	// second, up to RqObjectBurst built up while idle. Zero
+	// means unlimited (the historical behavior)
+	RqObjectRate  float64
+	RqObjectBurst float64
+
+	// MaxOutstandingWants caps how many Want subscriptions a
+	// single Conn may hold open at once, on top of the rate
+	// limit above. Zero means unlimited
+	MaxOutstandingWants int
+
+	// WantlistDelay is the batching window each Conn's
+	// Wantlist waits for more Get/GetMany calls to join the
+	// current batch before sending it as a single RqObjects.
+	// Zero falls back to DefaultWantlistDelay
+	WantlistDelay time.Duration
+
+	// MetricsAddress, if non-empty, makes Node.start launch an
+	// HTTP server on it serving Prometheus metrics at /metrics
+	// and the runtime profiler at /debug/pprof/*
+	MetricsAddress string
+
+	// WALCheckpointRecords and WALCheckpointPeriod configure
+	// the write-ahead log every on-disk IdxDB is wrapped with:
+	// the log is fsynced after WALCheckpointRecords records or
+	// every WALCheckpointPeriod, whichever comes first. Zero
+	// either falls back to the matching Default* constant
+	WALCheckpointRecords int
+	WALCheckpointPeriod  time.Duration
+}
+
+// NewConfig returns Config filled with default values
+func NewConfig() (c Config) {
+	c.Config = gnet.NewConfig()
+	c.ResponseTimeout = DefaultResponseTimeout
+	c.WALCheckpointRecords = DefaultWALCheckpointRecords
+	c.WALCheckpointPeriod = DefaultWALCheckpointPeriod
+	c.WantlistDelay = DefaultWantlistDelay
+	return
+}
+
+// Addresses is a list of network addresses with a
+// human-readable String representation used for logging
+type Addresses []string
+
+// String implements the fmt.Stringer interface
+func (a Addresses) String() string {
+	if len(a) == 0 {
+		return "<none>"
+	}
+	var s string
+	for i, addr := range a {
+		if i > 0 {
+			s += ", "
+		}
+		s += addr
+	}
+	return s
+}
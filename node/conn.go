@@ -13,6 +13,8 @@ import (
 	"github.com/skycoin/net/factory"
 
 	"github.com/skycoin/cxo/data"
+	"github.com/skycoin/cxo/node/consensus"
+	"github.com/skycoin/cxo/node/log"
 	"github.com/skycoin/cxo/node/msg"
 	"github.com/skycoin/cxo/skyobject"
 	"github.com/skycoin/cxo/skyobject/registry"
@@ -42,6 +44,14 @@ type Conn struct {
 
 	sendq chan<- []byte // channel from factory.Connection
 
+	cs *cipherStream // set once the authenticated handshake completes
+
+	limiter *connLimiter // throttles handleRqObject
+
+	wantlist *Wantlist // batches outgoing RqObject as RqObjects
+
+	logger log.Logger // bound with "addr"/"incoming", see newConnection
+
 	await  sync.WaitGroup  // wait for receiving loop
 	closeq <-chan struct{} //
 	closeo sync.Once       // close once
@@ -63,22 +73,52 @@ func (n *Node) newConnection(
 
 	c.n = n
 
+	c.logger = n.With("addr", fc.Address(), "incoming", isIncoming)
+
 	c.reqs = make(map[uint32]chan<- msg.Msg)
 
 	c.sendq = fc.GetChanOut()
 	c.closeq = make(chan struct{})
 
+	c.limiter = newConnLimiter(
+		n.conf.RqObjectRate,
+		n.conf.RqObjectBurst,
+		n.conf.MaxOutstandingWants,
+	)
+
+	var wantlistDelay = n.conf.WantlistDelay
+	if wantlistDelay <= 0 {
+		wantlistDelay = DefaultWantlistDelay
+	}
+	c.wantlist = newWantlist(c, wantlistDelay)
+
 	n.addPendingConn(c)
 
-	//
-	// the next step is c.handshake() and c.run()
-	//
+	// run() performs the handshake on its own goroutine before
+	// it starts receiving; newConnection returns without
+	// waiting for the handshake to complete
+	go c.run()
 
 	return
 }
 
-// start handling
+// run performs the authenticated handshake and, once it
+// succeeds, starts the receiving loop. No application messege
+// is handled until handshake() returns nil, so an unauthenticated
+// peer is never handed application messeges
 func (c *Conn) run() {
+
+	if err := c.handshake(c.n.conf.StaticPublicKey, c.n.conf.StaticSecretKey); err != nil {
+		c.fatality("handshake: ", err)
+		return
+	}
+
+	// now that the peer's identity is authenticated, remember
+	// how to reach it again: this is what makes FindProviders/
+	// Subscribe able to dial a NodeID it learns about later
+	c.n.kad.Add(c.peerID)
+	c.n.rememberAddr(c.peerID, c.Address())
+
 	c.await.Add(2)
 	go c.receiving()
 }
@@ -126,6 +166,14 @@ func (c *Conn) Node() (node *Node) {
 	return c.n
 }
 
+// Stats returns a snapshot of this Conn's request-handling
+// counters: how many RqObject requests were accepted, rate
+// limited, or rejected as unwanted, and how many Want
+// subscriptions are currently outstanding
+func (c *Conn) Stats() (st ConnStat) {
+	return c.limiter.stat()
+}
+
 // Address returns remote address
 // represetned as string
 func (c *Conn) Address() (address string) {
@@ -199,13 +247,24 @@ func (c *Conn) RemoteFeeds() (feeds []cipher.PubKey, err error) {
 	return
 }
 
-func (c *Conn) sendRoot(r *registry.Root) {
+// sendRoot pushes r as round's proposal. A freshly-published
+// Root (not yet subject to any consensus round) is pushed as
+// round 0; a BFT proposer re-pushing the same Root after an
+// earlier round timed out tags it with the round it is now
+// proposing for, so handleRoot on the other end can check it
+// against that round's proposer instead of always round 0
+func (c *Conn) sendRoot(r *registry.Root, round uint64) {
+	value := r.Encode()
+
+	c.n.metrics.BytesOut.WithLabelValues(r.Pub.Hex()).Add(float64(len(value)))
+
 	c.sendMsg(c.nextSeq(), 0, &msg.Root{
 		Feed:  r.Pub,
 		Nonce: r.Nonce,
 		Seq:   r.Seq,
+		Round: round,
 
-		Value: r.Encode(),
+		Value: value,
 
 		Sig: r.Sig,
 	})
@@ -216,7 +275,7 @@ func (c *Conn) sendLastRoot(pk cipher.PubKey) {
 
 	// ignore error
 	if r, _ := c.n.c.LastRoot(pk, c.n.c.ActiveHead(pk)); r != nil {
-		c.sendRoot(r)
+		c.sendRoot(r, 0)
 	}
 
 }
@@ -259,10 +318,20 @@ func (c *Conn) Subscribe(feed cipher.PubKey) (err error) {
 	}
 
 	c.n.fs.addConnFeed(c, feed)
+	c.n.persistent.rememberFeeds(c.Address(), c.Feeds())
 	c.sendLastRoot(pk)
 	return
 }
 
+// Wantlist returns the batching want-manager for this peer,
+// so callers that know they want many objects from this
+// specific Conn (e.g. a filler resolving an HArray's
+// children) can fetch them all in as few RqObjects round
+// trips as possible instead of one RqObject per key
+func (c *Conn) Wantlist() *Wantlist {
+	return c.wantlist
+}
+
 // just send the messege
 func (c *Conn) unsubscribe(pk cipher.PubKey) {
 	c.sendMsg(c.nextSeq(), 0, &msg.Unsub{
@@ -326,6 +395,61 @@ func (c *Conn) Preview(
 	return
 }
 
+// queryProviders asks this peer which NodeIDs provide feed,
+// remembering every (id, address) pair it gets back so a
+// later Node.Subscribe can dial them directly. Best-effort:
+// errors are swallowed since this only ever widens the set of
+// known providers opportunistically, it never is the only way
+// to find one
+func (c *Conn) queryProviders(feed cipher.PubKey) {
+
+	reply, err := c.sendRequest(&msg.RqProviders{Feed: feed})
+	if err != nil {
+		return
+	}
+
+	providers, ok := reply.(*msg.Providers)
+	if !ok {
+		return
+	}
+
+	for i, id := range providers.IDs {
+		if i >= len(providers.Addresses) {
+			break
+		}
+		c.n.rememberAddr(id, providers.Addresses[i])
+		c.n.kad.AnnounceProvider(feed, id)
+	}
+}
+
+// queryFindNode asks this peer for the NodeIDs it knows
+// closest to target, remembering every (id, address) pair it
+// gets back so the table actually learns new peers instead of
+// just bumping the stale bucket's seen time. Best-effort, the
+// same as queryProviders: it backs discover.Refresher, used to
+// opportunistically widen the table, never the only way a peer
+// is found
+func (c *Conn) queryFindNode(target cipher.PubKey) {
+
+	reply, err := c.sendRequest(&msg.RqFindNode{Target: target})
+	if err != nil {
+		return
+	}
+
+	nodes, ok := reply.(*msg.Nodes)
+	if !ok {
+		return
+	}
+
+	for i, id := range nodes.IDs {
+		if i >= len(nodes.Addresses) {
+			break
+		}
+		c.n.rememberAddr(id, nodes.Addresses[i])
+		c.n.kad.Add(id)
+	}
+}
+
 // implements skyobject.Getter wrapping
 // the Conn
 type cget struct {
@@ -400,11 +524,19 @@ func (c *Conn) encodeMsg(seq, rseq uint32, m msg.Msg) (raw []byte) {
 }
 
 func (c *Conn) sendMsg(seq, rseq uint32, m msg.Msg) {
+	c.n.metrics.MessagesSent.WithLabelValues(fmt.Sprintf("%T", m)).Inc()
 	c.sendRaw(c.encodeMsg(seq, rseq, m))
 }
 
 func (c *Conn) sendRaw(raw []byte) {
 
+	// c.cs is nil while the handshake itself is in flight (it's
+	// what the handshake is establishing); every messege sent
+	// after that goes out sealed
+	if c.cs != nil {
+		raw = c.cs.seal(raw)
+	}
+
 	select {
 	case c.sendq <- raw:
 	case <-c.closeq:
@@ -416,7 +548,7 @@ func (c *Conn) fatality(args ...interface{}) {
 
 	var err = errors.New(fmt.Sprint(args...))
 
-	c.n.Print("[ERR] ", err)
+	c.logger.Error("connection fatality", "err", err)
 	c.close(err)
 }
 
@@ -446,6 +578,15 @@ func (c *Conn) receiving() {
 				return
 			}
 
+			// c.cs is nil only while DisableHandshake skipped
+			// straight to the legacy plaintext exchange
+			if c.cs != nil {
+				if raw, err = c.cs.open(raw); err != nil {
+					c.fatality("cipherStream: ", err)
+					return
+				}
+			}
+
 			// [ 4 seq ][ 4 rseq ][ 1 msg type ]
 
 			if len(raw) < 9 {
@@ -466,6 +607,8 @@ func (c *Conn) receiving() {
 				return
 			}
 
+			c.n.metrics.MessagesReceived.WithLabelValues(fmt.Sprintf("%T", m)).Inc()
+
 			// the messege can be a response for a request
 			if rq, ok := c.isResponse(rseq); ok == true {
 				rq <- m
@@ -533,7 +676,7 @@ func (c *Conn) sendRequest(m msg.Msg) (reply msg.Msg, err error) {
 	c.sendMsg(seq, 0, m)
 
 	select {
-	case rq <- reply:
+	case reply = <-rq:
 		return
 
 	case <-tc:
@@ -581,8 +724,42 @@ func (c *Conn) handle(seq uint32, m msg.Msg) (err error) {
 	// obejcts
 
 	case *msg.RqObject: // <- RqO (key, prefetch)
+
+		// reject before allocating a goroutine: a peer
+		// requesting nonexistent hashes must not be able to
+		// pin arbitrary resources for free
+		if c.limiter.allow() == false {
+			c.sendErr(seq, errors.New("rate limited"))
+			return
+		}
+
+		if c.n.fs.reachable(x.Key) == false {
+			c.limiter.markUnwanted()
+			c.sendErr(seq, errors.New("unwanted"))
+			return
+		}
+
 		c.await.Add(1)
-		go c.handleRqObject(x)
+		go c.handleRqObject(seq, x)
+		return
+
+	case *msg.RqObjects: // <- RqOs (keys), batched RqObject
+
+		if c.limiter.allow() == false {
+			c.sendErr(seq, errors.New("rate limited"))
+			return
+		}
+
+		for _, key := range x.Keys {
+			if c.n.fs.reachable(key) == false {
+				c.limiter.markUnwanted()
+				c.sendErr(seq, errors.New("unwanted"))
+				return
+			}
+		}
+
+		c.await.Add(1)
+		go c.handleRqObjects(seq, x)
 		return
 
 	// preview
@@ -590,6 +767,26 @@ func (c *Conn) handle(seq uint32, m msg.Msg) (err error) {
 	case *msg.RqPreview: // -> RqPreview (feed)
 		return c.handleRqPreview(seq, x)
 
+	// discovery
+
+	case *msg.RqFindNode: // <- RqFindNode (target)
+		return c.handleRqFindNode(seq, x)
+
+	case *msg.RqProviders: // <- RqProviders (feed)
+		return c.handleRqProviders(seq, x)
+
+	// consensus (no reply; the reactor gossips votes itself)
+
+	case *msg.Proposal:
+		c.handleVote(consensus.ProposalKind, x.Feed, x.Nonce, x.Round, x.Root)
+		return
+	case *msg.Prevote:
+		c.handleVote(consensus.PrevoteKind, x.Feed, x.Nonce, x.Round, x.Root)
+		return
+	case *msg.Precommit:
+		c.handleVote(consensus.PrecommitKind, x.Feed, x.Nonce, x.Round, x.Root)
+		return
+
 	//
 	// delayed messeges (ignore them)
 	//
@@ -601,6 +798,8 @@ func (c *Conn) handle(seq uint32, m msg.Msg) (err error) {
 	case *msg.Err: // -> Err (delayed)
 	case *msg.Ok: // -> Ok (delayed)
 	case *msg.List: // -> List (delayed)
+	case *msg.Nodes: // -> Nodes (delayed)
+	case *msg.Providers: // -> Providers (delayed)
 
 	default:
 
@@ -680,6 +879,8 @@ func (c *Conn) handleRqList(seq uint32, rq *msg.RqList) (_ error) {
 // got Root (preview Root objects are handled by request-responnse, not here)
 func (c *Conn) handleRoot(root *msg.Root) (_ error) {
 
+	c.n.metrics.BytesIn.WithLabelValues(root.Feed.Hex()).Add(float64(len(root.Value)))
+
 	// check seq first (avoid verify-signature for old unwanted Root obejcts)
 
 	var last, err = c.n.c.LastRootSeq(root.Feed, root.Nonce) // last is full
@@ -704,7 +905,7 @@ func (c *Conn) handleRoot(root *msg.Root) (_ error) {
 	var r *registry.Root
 
 	if r, err = c.n.c.ReceivedRoot(root.Sig, root.Value); err != nil {
-		c.n.Printf("[ERR] [%s] received Root error: %s", c.String(), err)
+		c.logger.Error("received root", "err", err)
 		return // keep connection ?
 	}
 
@@ -713,15 +914,73 @@ func (c *Conn) handleRoot(root *msg.Root) (_ error) {
 		return
 	}
 
+	// a Root pushed directly over the wire (as opposed to a
+	// Proposal/Prevote/Precommit messege) stands for root.Round's
+	// proposal: the BFTReactor only accepts it from that round's
+	// proposer, then drives its own Prevote/Precommit from the
+	// Proposal/Prevote/Precommit messeges that follow;
+	// consensus.NoopReactor (the default) commits immediately,
+	// reproducing the historical behavior. Without tagging the
+	// push with its actual round, a proposer re-pushing the same
+	// Root after round 0 timed out would always be checked
+	// against round 0's proposer and rejected, leaving the head
+	// stuck forever past round 0
+	if c.n.Reactor().OnReceive(c.peerID, consensus.Head{
+		Feed:  root.Feed,
+		Nonce: root.Nonce,
+	}, consensus.ProposalKind, consensus.Vote{Round: root.Round, Root: r.Hash}) == false {
+		return // not committed yet, wait for more votes
+	}
+
 	// fill the Root only if the node and the connection
 	// subscribed to feed of the Root
 	c.n.fs.receivedRoot(c, r)
 	return
 }
 
+// handleVote feeds a received consensus messege (Proposal/
+// Prevote/Precommit) into the configured Reactor, which drives
+// its propose/prevote/precommit state machine off kind
+func (c *Conn) handleVote(
+	kind consensus.VoteKind,
+	feed cipher.PubKey,
+	nonce, round uint64,
+	root cipher.SHA256,
+) {
+	c.n.Reactor().OnReceive(c.peerID, consensus.Head{
+		Feed:  feed,
+		Nonce: nonce,
+	}, kind, consensus.Vote{Round: round, Root: root})
+}
+
+// sendVote sends a consensus messege (Proposal/Prevote/
+// Precommit) for head to this peer
+func (c *Conn) sendVote(head consensus.Head, kind consensus.VoteKind, v consensus.Vote) {
+	switch kind {
+	case consensus.ProposalKind:
+		c.sendMsg(c.nextSeq(), 0, &msg.Proposal{
+			Feed: head.Feed, Nonce: head.Nonce, Round: v.Round, Root: v.Root,
+		})
+	case consensus.PrevoteKind:
+		c.sendMsg(c.nextSeq(), 0, &msg.Prevote{
+			Feed: head.Feed, Nonce: head.Nonce, Round: v.Round, Root: v.Root,
+		})
+	case consensus.PrecommitKind:
+		c.sendMsg(c.nextSeq(), 0, &msg.Precommit{
+			Feed: head.Feed, Nonce: head.Nonce, Round: v.Round, Root: v.Root,
+		})
+	}
+}
+
 // async
+// handleRqObject is only reached once the caller (handle)
+// has confirmed the request passed the rate limiter and that
+// rq.Key is reachable from a Root this Conn is subscribed
+// to; it releases the limiter's outstanding-Want slot when
+// the request is done, one way or another
 func (c *Conn) handleRqObject(seq uint32, rq *msg.RqObject) {
 	defer c.await.Done()
+	defer c.limiter.release()
 
 	var (
 		val []byte
@@ -733,13 +992,6 @@ func (c *Conn) handleRqObject(seq uint32, rq *msg.RqObject) {
 		tc <-chan time.C
 	)
 
-	// TODO (kostyarin): the request holds resources and in good case
-	//                   it's ok, but it's possible to DDoS the Node
-	//                   perfoкming many trash request
-
-	// TODO (kostyarin): get the object or subscribe for the object
-	//                   only if it is wanted (to think)
-
 	c.n.c.Want(rq.Key, gc)
 	defer c.n.c.Unwant(rq.Key, gc) // to be memory safe
 
@@ -771,6 +1023,72 @@ func (c *Conn) handleRqObject(seq uint32, rq *msg.RqObject) {
 	return
 }
 
+// async
+// handleRqObjects is the batched counterpart of
+// handleRqObject, backing the Wantlist: it resolves every
+// key in rq.Keys concurrently and replies with a single
+// Objects messege, values in the same order as rq.Keys (a
+// nil entry means "don't have it"), so a caller fetching
+// many children in one round trip doesn't pay one round
+// trip per child. Like handleRqObject, it is only reached
+// once handle() has confirmed the whole batch passed the
+// rate limiter and every key is reachable, and it releases
+// the limiter's outstanding-Want slot when done
+func (c *Conn) handleRqObjects(seq uint32, rq *msg.RqObjects) {
+	defer c.await.Done()
+	defer c.limiter.release()
+
+	var values = make([][]byte, len(rq.Keys))
+
+	var wg sync.WaitGroup
+	wg.Add(len(rq.Keys))
+
+	for i, key := range rq.Keys {
+		go func(i int, key cipher.SHA256) {
+			defer wg.Done()
+			values[i] = c.fetchObjectValue(key)
+		}(i, key)
+	}
+
+	wg.Wait()
+
+	c.sendMsg(c.nextSeq(), seq, &msg.Objects{Values: values})
+}
+
+// fetchObjectValue waits for key to become available
+// locally, the same way handleRqObject does, up to the
+// configured response timeout, returning nil if it never
+// arrives or the Conn closes first
+func (c *Conn) fetchObjectValue(key cipher.SHA256) (val []byte) {
+	var gc = make(chan skyobject.Object, 1)
+
+	c.n.c.Want(key, gc)
+	defer c.n.c.Unwant(key, gc) // to be memory safe
+
+	select {
+	case obj := <-gc:
+		return obj.Val
+	default:
+		// wait
+	}
+
+	var tc <-chan time.Time
+	if rt := c.n.config.ResponseTimeout; rt > 0 {
+		tm := time.NewTimer(rt)
+		defer tm.Stop()
+		tc = tm.C
+	}
+
+	select {
+	case obj := <-gc:
+		return obj.Val
+	case <-tc:
+		return nil // timeout
+	case <-c.closeq:
+		return nil // closed
+	}
+}
+
 func (c *Conn) handleRqPreview(seq uint32, rqp *msg.RqPreview) (_ error) {
 
 	var r, err = c.n.c.LastRoot(rqp.Feed, c.n.c.ActiveHead(rqp.Feed))
@@ -791,3 +1109,43 @@ func (c *Conn) handleRqPreview(seq uint32, rqp *msg.RqPreview) (_ error) {
 
 	return
 }
+
+// handleRqFindNode replies with the NodeIDs (and addresses,
+// where this Node has a dialable one on hand) closest to
+// rq.Target that it knows about, per the Kademlia table
+func (c *Conn) handleRqFindNode(seq uint32, rq *msg.RqFindNode) (_ error) {
+
+	var ids, addrs = c.n.resolvableNodes(c.n.kad.Closest(rq.Target, 8))
+
+	c.sendMsg(c.nextSeq(), seq, &msg.Nodes{IDs: ids, Addresses: addrs})
+	return
+}
+
+// handleRqProviders replies with the NodeIDs (and addresses)
+// of peers this Node believes provide rq.Feed: itself, if it
+// shares the feed, plus every other Conn it has that shares it
+func (c *Conn) handleRqProviders(seq uint32, rq *msg.RqProviders) (_ error) {
+
+	var ids []cipher.PubKey
+
+	if c.n.HasFeed(rq.Feed) {
+		ids = append(ids, c.n.conf.StaticPublicKey)
+	}
+
+	for _, other := range c.n.Connections() {
+		if other == c {
+			continue
+		}
+		for _, feed := range other.Feeds() {
+			if feed == rq.Feed {
+				ids = append(ids, other.PeerID())
+				break
+			}
+		}
+	}
+
+	idsResolved, addrs := c.n.resolvableNodes(ids)
+
+	c.sendMsg(c.nextSeq(), seq, &msg.Providers{IDs: idsResolved, Addresses: addrs})
+	return
+}
@@ -0,0 +1,371 @@
+// Package consensus provides pluggable ordering of Root
+// objects across a feed's subscribers, so that a forked or
+// compromised publisher can't push conflicting Roots to
+// different subsets of subscribers and have them silently
+// diverge. The default Reactor is a Tendermint-style
+// propose/prevote/precommit round, with the proposer rotating
+// by round number and a round timeout that skips to the next
+// proposer if the current one never shows up: a Root is only
+// "committed" (and thus surfaced to the node package's onRoot
+// callback) once 2/3+ of a configured voting-power set have
+// precommitted to it within a round
+package consensus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// DefaultRoundTimeout is used by NewBFTReactor when
+// roundTimeout is zero: how long a round waits for its
+// proposer before skipping to the next one
+const DefaultRoundTimeout = 10 * time.Second
+
+// A Head identifies the Root stream a round of consensus
+// runs over: one feed, one head (nonce)
+type Head struct {
+	Feed  cipher.PubKey
+	Nonce uint64
+}
+
+// A Reactor plugs into Conn.handleRoot and Node, deciding
+// when a received Root becomes committed. Start/Stop bound
+// its lifetime with the Node's; OnReceive is called for
+// every vote/proposal messege arriving on any Conn for a
+// feed the reactor cares about, labelled with the VoteKind it
+// arrived as (Proposal/Prevote/Precommit). The interface has
+// no Broadcast method: a reactor sends its own votes through
+// the Broadcaster it was built with. Implementations in this
+// package: the default BFTReactor below and NoopReactor for
+// existing trust-everything behavior; others can be set with
+// Node.SetReactor
+type Reactor interface {
+	Start() error
+	Stop() error
+
+	// OnReceive handles a consensus messege of the given kind
+	// received on some Conn. Returns true if/when the
+	// accompanying Root (identified by hash) has just become
+	// committed as a result
+	OnReceive(from cipher.PubKey, head Head, kind VoteKind, v Vote) (committed bool)
+
+	// Outgoing votes go through the Broadcaster given to
+	// NewBFTReactor, not through a Reactor method; Node wires
+	// it to "send to every Conn subscribed to Head.Feed"
+}
+
+// A Vote is the payload of a Proposal/Prevote/Precommit; the
+// node/msg package defines the wire messeges that carry it.
+// A zero Root means a nil vote (e.g. a round-skip Prevote cast
+// without a candidate)
+type Vote struct {
+	Round uint64
+	Root  cipher.SHA256
+}
+
+// A Broadcaster sends a consensus Vote of given kind to
+// every Conn subscribed to head.Feed. Implemented by
+// node.Node
+type Broadcaster interface {
+	BroadcastVote(head Head, kind VoteKind, v Vote)
+}
+
+// VoteKind distinguishes the three message kinds of a round
+type VoteKind byte
+
+// vote kinds
+const (
+	ProposalKind VoteKind = iota
+	PrevoteKind
+	PrecommitKind
+)
+
+// a round tracks one (feed, nonce, round number)'s voting
+// state: the proposer's claim (if it has arrived yet) and the
+// tallies of prevotes/precommits seen so far
+type round struct {
+	gotProposal bool
+	proposal    cipher.SHA256
+
+	prevotes   map[cipher.PubKey]cipher.SHA256
+	precommits map[cipher.PubKey]cipher.SHA256
+
+	prevoted     bool // this node has already cast its own Prevote
+	precommitted bool // this node has already cast its own Precommit
+
+	timer *time.Timer // fires onRoundTimeout if the round never commits
+}
+
+func newRound() *round {
+	return &round{
+		prevotes:   make(map[cipher.PubKey]cipher.SHA256),
+		precommits: make(map[cipher.PubKey]cipher.SHA256),
+	}
+}
+
+// a headState tracks rounds for a single Head, plus the
+// hash that has already committed (if any)
+type headState struct {
+	rounds    map[uint64]*round
+	committed cipher.SHA256
+}
+
+// BFTReactor is the default Reactor: a minimal Tendermint-
+// style propose/prevote/precommit scheme over a fixed voting-
+// power set (one vote per configured pubkey; no weights). The
+// proposer of round N is voters[N % len(voters)], so every
+// voter must be constructed with the same voters slice, in the
+// same order, for rotation to agree across the set
+type BFTReactor struct {
+	self     cipher.PubKey
+	voters   []cipher.PubKey
+	voterSet map[cipher.PubKey]struct{}
+	bc       Broadcaster
+
+	roundTimeout time.Duration
+
+	mx     sync.Mutex
+	heads  map[Head]*headState
+	closed bool
+}
+
+// NewBFTReactor creates a Reactor that only commits a Root
+// once 2/3+ of voters have precommitted to it within a round.
+// self is this node's own voting identity (zero if this node
+// doesn't vote, e.g. it only relays); bc is used to gossip
+// this node's own votes to the rest of the feed's subscribers.
+// roundTimeout, if zero, defaults to DefaultRoundTimeout
+func NewBFTReactor(self cipher.PubKey, voters []cipher.PubKey, bc Broadcaster, roundTimeout time.Duration) (r *BFTReactor) {
+	r = new(BFTReactor)
+	r.self = self
+	r.voters = append([]cipher.PubKey(nil), voters...)
+	r.voterSet = make(map[cipher.PubKey]struct{}, len(voters))
+	for _, v := range voters {
+		r.voterSet[v] = struct{}{}
+	}
+	r.bc = bc
+	r.roundTimeout = roundTimeout
+	if r.roundTimeout <= 0 {
+		r.roundTimeout = DefaultRoundTimeout
+	}
+	r.heads = make(map[Head]*headState)
+	return
+}
+
+// Start implements the Reactor interface
+func (r *BFTReactor) Start() error { return nil }
+
+// Stop implements the Reactor interface
+func (r *BFTReactor) Stop() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	r.closed = true
+	for _, hs := range r.heads {
+		for _, rnd := range hs.rounds {
+			if rnd.timer != nil {
+				rnd.timer.Stop()
+			}
+		}
+	}
+	return nil
+}
+
+// quorum is the 2/3+ threshold over the voting-power set
+func (r *BFTReactor) quorum() int {
+	return (len(r.voters) * 2 / 3) + 1
+}
+
+// proposer returns the voter responsible for proposing round n
+func (r *BFTReactor) proposer(n uint64) cipher.PubKey {
+	if len(r.voters) == 0 {
+		return cipher.PubKey{}
+	}
+	return r.voters[n%uint64(len(r.voters))]
+}
+
+// ensureRoundLocked returns the round's state, creating it (and
+// arming its timeout) on first use
+func (r *BFTReactor) ensureRoundLocked(head Head, hs *headState, n uint64) *round {
+	rnd, ok := hs.rounds[n]
+	if ok {
+		return rnd
+	}
+
+	rnd = newRound()
+	hs.rounds[n] = rnd
+	rnd.timer = time.AfterFunc(r.roundTimeout, func() { r.onRoundTimeout(head, n) })
+	return rnd
+}
+
+// onRoundTimeout skips to round n+1 if head hasn't committed
+// yet, casting a nil Prevote for the new round so other voters
+// waiting on this node can also move on
+func (r *BFTReactor) onRoundTimeout(head Head, n uint64) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	hs, ok := r.heads[head]
+	if !ok || hs.committed != (cipher.SHA256{}) {
+		return
+	}
+
+	if _, ok := hs.rounds[n+1]; ok {
+		return // already advanced, e.g. by a remote Proposal arriving first
+	}
+
+	next := r.ensureRoundLocked(head, hs, n+1)
+	r.castLocked(head, n+1, PrevoteKind, cipher.SHA256{}, next)
+}
+
+// castLocked casts this node's own vote of kind for root (only
+// once per round per kind) and broadcasts it, whether it was
+// triggered by our own proposal or by tallying remote votes
+func (r *BFTReactor) castLocked(head Head, n uint64, kind VoteKind, root cipher.SHA256, rnd *round) {
+	switch kind {
+	case PrevoteKind:
+		if rnd.prevoted {
+			return
+		}
+		rnd.prevoted = true
+	case PrecommitKind:
+		if rnd.precommitted {
+			return
+		}
+		rnd.precommitted = true
+	}
+
+	if _, ok := r.voterSet[r.self]; ok {
+		switch kind {
+		case PrevoteKind:
+			rnd.prevotes[r.self] = root
+		case PrecommitKind:
+			rnd.precommits[r.self] = root
+		}
+	}
+
+	if r.bc != nil {
+		r.bc.BroadcastVote(head, kind, Vote{Round: n, Root: root})
+	}
+}
+
+// tallyMatches reports whether at least quorum voters voted
+// for want, a non-nil root
+func tallyMatches(votes map[cipher.PubKey]cipher.SHA256, want cipher.SHA256, quorum int) bool {
+	if want == (cipher.SHA256{}) {
+		return false
+	}
+	count := 0
+	for _, root := range votes {
+		if root == want {
+			count++
+		}
+	}
+	return count >= quorum
+}
+
+// majority returns the root, if any, that at least quorum
+// voters agree on
+func majority(votes map[cipher.PubKey]cipher.SHA256, quorum int) (root cipher.SHA256, ok bool) {
+	tally := make(map[cipher.SHA256]int)
+	for _, r := range votes {
+		tally[r]++
+	}
+	for r, count := range tally {
+		if count >= quorum && r != (cipher.SHA256{}) {
+			return r, true
+		}
+	}
+	return cipher.SHA256{}, false
+}
+
+// OnReceive implements the Reactor interface
+func (r *BFTReactor) OnReceive(from cipher.PubKey, head Head, kind VoteKind, v Vote) (committed bool) {
+
+	if _, ok := r.voterSet[from]; !ok {
+		return false // not a voter: ignored, not an error
+	}
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.closed {
+		return false
+	}
+
+	hs, ok := r.heads[head]
+	if !ok {
+		hs = &headState{rounds: make(map[uint64]*round)}
+		r.heads[head] = hs
+	}
+
+	if hs.committed != (cipher.SHA256{}) {
+		return false // this head already has a committed Root
+	}
+
+	rnd := r.ensureRoundLocked(head, hs, v.Round)
+
+	switch kind {
+
+	case ProposalKind:
+
+		if from != r.proposer(v.Round) {
+			return false // only the round's proposer may propose
+		}
+		if rnd.gotProposal {
+			return false // already have this round's proposal
+		}
+
+		rnd.gotProposal = true
+		rnd.proposal = v.Root
+
+		r.castLocked(head, v.Round, PrevoteKind, v.Root, rnd)
+
+	case PrevoteKind:
+
+		rnd.prevotes[from] = v.Root
+
+		if rnd.gotProposal && tallyMatches(rnd.prevotes, rnd.proposal, r.quorum()) {
+			r.castLocked(head, v.Round, PrecommitKind, rnd.proposal, rnd)
+		}
+
+	case PrecommitKind:
+
+		rnd.precommits[from] = v.Root
+
+		if root, ok := majority(rnd.precommits, r.quorum()); ok {
+			hs.committed = root
+			if rnd.timer != nil {
+				rnd.timer.Stop()
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// NoopReactor commits every Root immediately, reproducing
+// the historical "accept any Root with Seq > last" behavior.
+// Useful as the default when a user hasn't configured voting
+// power, or for single-publisher feeds where BFT ordering is
+// unnecessary overhead
+type NoopReactor struct{}
+
+// Start implements the Reactor interface
+func (NoopReactor) Start() error { return nil }
+
+// Stop implements the Reactor interface
+func (NoopReactor) Stop() error { return nil }
+
+// OnReceive implements the Reactor interface: every vote
+// commits immediately
+func (NoopReactor) OnReceive(cipher.PubKey, Head, VoteKind, Vote) (committed bool) {
+	return true
+}
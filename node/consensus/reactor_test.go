@@ -0,0 +1,161 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+type voteCall struct {
+	head Head
+	kind VoteKind
+	v    Vote
+}
+
+// fakeBroadcaster records every BroadcastVote call and mirrors
+// it onto a channel so tests can wait for async ones (e.g. a
+// round-timeout skip fired from a time.AfterFunc)
+type fakeBroadcaster struct {
+	ch chan voteCall
+}
+
+func newFakeBroadcaster() *fakeBroadcaster {
+	return &fakeBroadcaster{ch: make(chan voteCall, 16)}
+}
+
+func (f *fakeBroadcaster) BroadcastVote(head Head, kind VoteKind, v Vote) {
+	f.ch <- voteCall{head, kind, v}
+}
+
+func pubkey(b byte) (pk cipher.PubKey) {
+	pk[0] = b
+	return
+}
+
+// TestBFTReactorQuorumCommits drives a 3-voter round through
+// Proposal, both phases of voting, and checks that the round
+// only commits once 2/3+ of precommits agree, with this node's
+// own Prevote/Precommit actually broadcast along the way
+func TestBFTReactorQuorumCommits(t *testing.T) {
+
+	v0, v1, v2 := pubkey(1), pubkey(2), pubkey(3)
+	voters := []cipher.PubKey{v0, v1, v2} // proposer(0) == v0
+
+	bc := newFakeBroadcaster()
+	r := NewBFTReactor(v1, voters, bc, time.Minute)
+
+	head := Head{Feed: pubkey(9), Nonce: 1}
+	var root cipher.SHA256
+	root[0] = 0x42
+
+	// the proposer's proposal: self (v1) should Prevote in response
+	if committed := r.OnReceive(v0, head, ProposalKind, Vote{Round: 0, Root: root}); committed {
+		t.Fatal("committed too early, on proposal alone")
+	}
+
+	select {
+	case call := <-bc.ch:
+		if call.kind != PrevoteKind || call.v.Root != root {
+			t.Fatalf("unexpected broadcast after proposal: %+v", call)
+		}
+	default:
+		t.Fatal("expected self Prevote to be broadcast after accepting the proposal")
+	}
+
+	// two more Prevotes (from v0 and v2) should reach quorum (3)
+	// together with self's own recorded Prevote, triggering a
+	// self Precommit
+	if committed := r.OnReceive(v0, head, PrevoteKind, Vote{Round: 0, Root: root}); committed {
+		t.Fatal("committed too early, on 2 prevotes")
+	}
+	if committed := r.OnReceive(v2, head, PrevoteKind, Vote{Round: 0, Root: root}); committed {
+		t.Fatal("committed too early, precommit phase hasn't quorate yet")
+	}
+
+	select {
+	case call := <-bc.ch:
+		if call.kind != PrecommitKind || call.v.Root != root {
+			t.Fatalf("unexpected broadcast after prevote quorum: %+v", call)
+		}
+	default:
+		t.Fatal("expected self Precommit to be broadcast once prevotes reached quorum")
+	}
+
+	// two more Precommits reach quorum and commit the round
+	if committed := r.OnReceive(v0, head, PrecommitKind, Vote{Round: 0, Root: root}); committed {
+		t.Fatal("committed too early, only 2 of 3 precommits in")
+	}
+	if committed := r.OnReceive(v2, head, PrecommitKind, Vote{Round: 0, Root: root}); !committed {
+		t.Fatal("expected quorum of precommits to commit the round")
+	}
+}
+
+// TestBFTReactorRejectsNonProposerProposal checks that a
+// Proposal from anyone but the round's proposer is ignored,
+// so an off-rotation voter can't hijack a round
+func TestBFTReactorRejectsNonProposerProposal(t *testing.T) {
+
+	v0, v1, v2 := pubkey(1), pubkey(2), pubkey(3)
+	voters := []cipher.PubKey{v0, v1, v2} // proposer(0) == v0
+
+	bc := newFakeBroadcaster()
+	r := NewBFTReactor(v2, voters, bc, time.Minute)
+
+	head := Head{Feed: pubkey(9), Nonce: 1}
+	var root cipher.SHA256
+	root[0] = 0x7
+
+	r.OnReceive(v1, head, ProposalKind, Vote{Round: 0, Root: root})
+
+	select {
+	case call := <-bc.ch:
+		t.Fatalf("a non-proposer's proposal must not be accepted, got broadcast: %+v", call)
+	default:
+		// good: nothing broadcast, proposal from v1 was ignored
+	}
+
+	// the real proposer's proposal is still accepted afterwards
+	if committed := r.OnReceive(v0, head, ProposalKind, Vote{Round: 0, Root: root}); committed {
+		t.Fatal("committed too early, on proposal alone")
+	}
+	select {
+	case call := <-bc.ch:
+		if call.kind != PrevoteKind {
+			t.Fatalf("expected a Prevote broadcast, got %+v", call)
+		}
+	default:
+		t.Fatal("expected the real proposer's proposal to be accepted")
+	}
+}
+
+// TestBFTReactorRoundTimeoutAdvances checks that a round which
+// never hears from its proposer times out and skips to the
+// next proposer, casting a nil Prevote for the new round
+func TestBFTReactorRoundTimeoutAdvances(t *testing.T) {
+
+	v0, v1 := pubkey(1), pubkey(2)
+	voters := []cipher.PubKey{v0, v1} // proposer(0) == v0, proposer(1) == v1
+
+	bc := newFakeBroadcaster()
+	r := NewBFTReactor(v1, voters, bc, 20*time.Millisecond)
+
+	head := Head{Feed: pubkey(9), Nonce: 1}
+
+	// touch round 0 so its timer is armed, without a proposal
+	// ever arriving
+	r.OnReceive(v0, head, PrevoteKind, Vote{Round: 0})
+
+	select {
+	case call := <-bc.ch:
+		if call.kind != PrevoteKind || call.v.Round != 1 || call.v.Root != (cipher.SHA256{}) {
+			t.Fatalf("expected a nil round-1 Prevote skip, got %+v", call)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("round never timed out and skipped")
+	}
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
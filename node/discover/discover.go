@@ -0,0 +1,368 @@
+// Package discover implements a Kademlia-style provider
+// discovery layer, keyed by cipher.PubKey feed IDs instead
+// of the usual node IDs, so that Conn.Preview/Subscribe can
+// locate peers that share a feed without already knowing
+// about a public server that shares it
+package discover
+
+import (
+	"context"
+	"crypto/rand"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+const (
+	// bucketSize is "k" in the Kademlia literature: the
+	// maximum number of NodeIDs tracked per distance bucket
+	bucketSize = 20
+
+	// idBits is the width in bits of the key space (a
+	// cipher.PubKey is 33 bytes; we use all of it)
+	idBits = len(cipher.PubKey{}) * 8
+
+	// refreshInterval is how often a bucket that has not
+	// seen activity is refreshed by looking up a random ID
+	// that falls inside it
+	refreshInterval = 15 * time.Minute
+)
+
+// A Table is a Kademlia routing table over NodeIDs, and the
+// set of providers announced for feeds this node has learned
+// about. It is safe for concurrent use
+type Table struct {
+	self cipher.PubKey
+
+	mx      sync.Mutex
+	buckets [idBits]*bucket
+
+	// provided[feed][nodeID] = last time that node announced
+	// it provides the feed
+	provided map[cipher.PubKey]map[cipher.PubKey]time.Time
+
+	refresher Refresher // set via SetRefresher; nil means no-op
+
+	quit chan struct{}
+	once sync.Once
+}
+
+// A Refresher performs the actual network lookup a stale
+// bucket's refresh requires: it issues an RqFindNode for
+// target against whatever connections the caller maintains
+// (this package has no Conn pool of its own) and feeds any
+// discovered peers back into the Table via Add. node.Node
+// implements this by dialing its known peers' RqFindNode
+type Refresher interface {
+	RefreshBucket(ctx context.Context, target cipher.PubKey)
+}
+
+// SetRefresher installs the Refresher used by refreshStale to
+// perform real Kademlia lookups. Until set, a stale bucket
+// just has its seen timestamp bumped, deferring the lookup
+func (t *Table) SetRefresher(r Refresher) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.refresher = r
+}
+
+// a bucket holds up to bucketSize NodeIDs at the same XOR
+// distance range from self, ordered least-recently-seen
+// first (the classic Kademlia LRU eviction policy)
+type bucket struct {
+	mx      sync.Mutex
+	entries []cipher.PubKey
+	seen    time.Time
+}
+
+// NewTable creates a routing table for a node identified by
+// self
+func NewTable(self cipher.PubKey) (t *Table) {
+	t = new(Table)
+	t.self = self
+	for i := range t.buckets {
+		t.buckets[i] = new(bucket)
+	}
+	t.provided = make(map[cipher.PubKey]map[cipher.PubKey]time.Time)
+	t.quit = make(chan struct{})
+
+	go t.refreshLoop()
+	return
+}
+
+// Close stops the background bucket-refresh goroutine
+func (t *Table) Close() {
+	t.once.Do(func() { close(t.quit) })
+}
+
+// Add records that peer is reachable, inserting it into the
+// bucket for its XOR distance from self
+func (t *Table) Add(peer cipher.PubKey) {
+	if peer == t.self {
+		return
+	}
+	t.bucketFor(peer).add(peer)
+}
+
+func (b *bucket) add(id cipher.PubKey) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.seen = time.Now()
+
+	for i, e := range b.entries {
+		if e == id {
+			// move to the back (most-recently-seen)
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			b.entries = append(b.entries, id)
+			return
+		}
+	}
+
+	if len(b.entries) >= bucketSize {
+		b.entries = b.entries[1:] // evict least-recently-seen
+	}
+	b.entries = append(b.entries, id)
+}
+
+// bucketFor returns the bucket that peer falls into, based
+// on the index of the highest differing bit between self
+// and peer (distance 2^i <= d < 2^(i+1))
+func (t *Table) bucketFor(peer cipher.PubKey) *bucket {
+	return t.buckets[bucketIndex(t.self, peer)]
+}
+
+func bucketIndex(a, b cipher.PubKey) int {
+	d := xorDistance(a, b)
+	for byteIdx, byt := range d {
+		if byt == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if byt&(0x80>>uint(bit)) != 0 {
+				return idBits - 1 - (byteIdx*8 + bit)
+			}
+		}
+	}
+	return 0 // a == b, shouldn't happen since Add skips self
+}
+
+func xorDistance(a, b cipher.PubKey) (d cipher.PubKey) {
+	for i := range a {
+		d[i] = a[i] ^ b[i]
+	}
+	return
+}
+
+// Closest returns up to max NodeIDs from the table sorted by
+// XOR distance to target, ascending. Used to answer a peer's
+// RqFindNode
+func (t *Table) Closest(target cipher.PubKey, max int) (ids []cipher.PubKey) {
+	return t.closest(target, max)
+}
+
+// closest returns up to max NodeIDs from the table sorted by
+// XOR distance to target, ascending
+func (t *Table) closest(target cipher.PubKey, max int) (ids []cipher.PubKey) {
+	for _, buck := range t.buckets {
+		buck.mx.Lock()
+		ids = append(ids, buck.entries...)
+		buck.mx.Unlock()
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		di := xorDistance(target, ids[i])
+		dj := xorDistance(target, ids[j])
+		return lessBytes(di[:], dj[:])
+	})
+
+	if len(ids) > max {
+		ids = ids[:max]
+	}
+	return
+}
+
+func lessBytes(a, b []byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// Provide announces that self provides given feed, so it
+// will be returned by other nodes' FindProvidersAsync for
+// that feed once they learn of self through the table
+func (t *Table) Provide(feed cipher.PubKey) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	ps, ok := t.provided[feed]
+	if !ok {
+		ps = make(map[cipher.PubKey]time.Time)
+		t.provided[feed] = ps
+	}
+	ps[t.self] = time.Now()
+}
+
+// AnnounceProvider records that peer provides feed; called
+// by the node package when a Providers/Nodes reply (or an
+// unsolicited announcement) arrives over the wire for feed
+func (t *Table) AnnounceProvider(feed cipher.PubKey, peer cipher.PubKey) {
+	t.Add(peer)
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	ps, ok := t.provided[feed]
+	if !ok {
+		ps = make(map[cipher.PubKey]time.Time)
+		t.provided[feed] = ps
+	}
+	ps[peer] = time.Now()
+}
+
+// FindProvidersAsync looks up nodes providing given feed,
+// starting from the closest known peers and walking the
+// table outward. It streams results as they are found and
+// stops after max results or when ctx is done. The walk
+// itself is local to the Table; wiring a network query
+// (msg.RqFindNode/RqProviders round trips against peers in
+// the returned set) is the caller's job, e.g. Node.Subscribe
+// dialing whatever this yields
+func (t *Table) FindProvidersAsync(ctx context.Context, feed cipher.PubKey, max int) <-chan cipher.PubKey {
+
+	out := make(chan cipher.PubKey, max)
+
+	go func() {
+		defer close(out)
+
+		t.mx.Lock()
+		var known []cipher.PubKey
+		for id := range t.provided[feed] {
+			known = append(known, id)
+		}
+		t.mx.Unlock()
+
+		sort.Slice(known, func(i, j int) bool {
+			di := xorDistance(feed, known[i])
+			dj := xorDistance(feed, known[j])
+			return lessBytes(di[:], dj[:])
+		})
+
+		if len(known) > max {
+			known = known[:max]
+		}
+
+		for _, id := range known {
+			select {
+			case out <- id:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if len(known) < max {
+			// fall back to nodes merely close to the feed's
+			// key even if they haven't announced providing it
+			// yet; the caller can still ask them via RqFindNode.
+			// Providers already sent are skipped
+			seen := make(map[cipher.PubKey]struct{}, len(known))
+			for _, id := range known {
+				seen[id] = struct{}{}
+			}
+			sent := len(known)
+			for _, id := range t.closest(feed, max+len(known)) {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				if sent >= max {
+					return
+				}
+				select {
+				case out <- id:
+					sent++
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func (t *Table) refreshLoop() {
+	tk := time.NewTicker(refreshInterval)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-tk.C:
+			t.refreshStale()
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+// refreshStale walks buckets that have seen no activity
+// within refreshInterval and, if a Refresher is installed,
+// kicks off a real lookup (RqFindNode for a random ID that
+// falls inside the bucket's range) for each one; the bucket's
+// seen time is bumped right away so a slow or stuck lookup
+// doesn't make refreshLoop retrigger it every tick
+func (t *Table) refreshStale() {
+	now := time.Now()
+
+	t.mx.Lock()
+	refresher := t.refresher
+	t.mx.Unlock()
+
+	for i, b := range t.buckets {
+		b.mx.Lock()
+		due := len(b.entries) > 0 && now.Sub(b.seen) > refreshInterval
+		if due {
+			b.seen = now
+		}
+		b.mx.Unlock()
+
+		if !due || refresher == nil {
+			continue
+		}
+
+		go refresher.RefreshBucket(context.Background(), randomIDInBucket(t.self, i))
+	}
+}
+
+// randomIDInBucket returns a random PubKey whose XOR distance
+// from self falls in bucket index i: bits above the flipped
+// one match self (so the result can't land in a nearer
+// bucket), the flipped bit differs from self (guaranteeing
+// bucket i rather than a farther one), and every lower bit is
+// random
+func randomIDInBucket(self cipher.PubKey, i int) (id cipher.PubKey) {
+	id = self
+
+	var randBits cipher.PubKey
+	if _, err := rand.Read(randBits[:]); err != nil {
+		mrand.Read(randBits[:])
+	}
+
+	flipPos := idBits - 1 - i // bit index counted from the MSB
+
+	for bit := flipPos; bit < idBits; bit++ {
+		byteIdx, mask := bit/8, byte(0x80>>uint(bit%8))
+		if bit == flipPos {
+			id[byteIdx] ^= mask // flip: guarantees bucket i
+		} else {
+			id[byteIdx] = (id[byteIdx] &^ mask) | (randBits[byteIdx] & mask)
+		}
+	}
+
+	return
+}
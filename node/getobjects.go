@@ -0,0 +1,201 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/skycoin/cxo/node/msg"
+)
+
+// ErrNoKeys occurs when GetObjects is called with an empty
+// key list
+var ErrNoKeys = errors.New("node: GetObjects called with no keys")
+
+// A FoundObject is one object GetObjects has fetched: the
+// key that was requested and its decoded value
+type FoundObject struct {
+	Key   cipher.SHA256
+	Value []byte
+}
+
+// an inflightFetch lets concurrent GetObjects calls for the
+// same key share a single wire round trip: the first caller
+// becomes the leader and broadcasts the request, everyone
+// else just waits on done
+type inflightFetch struct {
+	done chan struct{}
+	val  []byte
+	ok   bool
+}
+
+// GetObjects fetches given keys from any connection of
+// this Node, shared feed or not, modeled after Bitswap's
+// GetBlocks: it returns immediately with a channel that
+// yields a FoundObject for every key that arrives, in
+// whatever order peers reply, and closes once every key is
+// satisfied or ctx is done. Concurrent requests for the same
+// key (from this call or another GetObjects call running at
+// the same time) are deduplicated so only one RqObject goes
+// out on the wire per key. This is the primary fetch API;
+// the skyobject fillers should use it in place of a
+// fire-and-forget send
+func (s *Node) GetObjects(ctx context.Context, keys []cipher.SHA256) (<-chan FoundObject, error) {
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	var out = make(chan FoundObject, len(keys))
+
+	var wg sync.WaitGroup
+	wg.Add(len(keys))
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	for _, key := range keys {
+		go func(key cipher.SHA256) {
+			defer wg.Done()
+
+			val, ok := s.fetchOne(ctx, key)
+			if ok == false {
+				return
+			}
+
+			select {
+			case out <- FoundObject{Key: key, Value: val}:
+			case <-ctx.Done():
+			}
+		}(key)
+	}
+
+	return out, nil
+}
+
+// HasObject is a shortcut for GetObjects with a single key,
+// returning as soon as that key is found or ctx is done
+func (s *Node) HasObject(ctx context.Context, key cipher.SHA256) (ok bool) {
+	_, ok = s.fetchOne(ctx, key)
+	return
+}
+
+// fetchOne resolves a single key, deduplicating concurrent
+// requests for it across all in-flight GetObjects/HasObject
+// calls. The first caller for a key becomes its leader and
+// starts resolveInflight to broadcast an RqObject to every
+// connection, whatever feeds it shares; every caller, leader
+// included, just waits on the shared result or its own ctx
+func (s *Node) fetchOne(ctx context.Context, key cipher.SHA256) (val []byte, ok bool) {
+
+	s.imx.Lock()
+	f, exists := s.inflight[key]
+	if !exists {
+		f = &inflightFetch{done: make(chan struct{})}
+		s.inflight[key] = f
+	}
+	s.imx.Unlock()
+
+	if !exists {
+		go s.resolveInflight(f, key)
+	}
+
+	select {
+	case <-f.done:
+		return f.val, f.ok
+	case <-ctx.Done():
+		return nil, false
+	}
+}
+
+// resolveInflight performs the actual broadcast for an
+// inflightFetch on an internal context tied to the Node's own
+// lifetime, not to whichever caller happened to become the
+// leader in fetchOne: the leader only decides who broadcasts,
+// it must not tie the shared result to the leader's ctx, or
+// every other waiter for the same key would incorrectly see
+// ok=false the instant the leader's own ctx canceled, even
+// though their own ctx is still live
+func (s *Node) resolveInflight(f *inflightFetch, key cipher.SHA256) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-s.Quiting():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	f.val, f.ok = s.broadcastRequestObject(ctx, key)
+	close(f.done)
+
+	s.imx.Lock()
+	delete(s.inflight, key)
+	s.imx.Unlock()
+}
+
+// broadcastRequestObject sends an RqObject for key to every
+// connection this Node currently has and returns the first
+// successful reply, or ok=false if none arrives before ctx
+// is done or every connection has answered/errored
+func (s *Node) broadcastRequestObject(ctx context.Context, key cipher.SHA256) (val []byte, ok bool) {
+
+	conns := s.Connections()
+	if len(conns) == 0 {
+		return nil, false
+	}
+
+	type reply struct {
+		val []byte
+		ok  bool
+	}
+
+	replies := make(chan reply, len(conns))
+
+	var wg sync.WaitGroup
+	wg.Add(len(conns))
+
+	for _, c := range conns {
+		go func(c *Conn) {
+			defer wg.Done()
+
+			m, err := c.sendRequest(&msg.RqObject{Key: key})
+			if err != nil {
+				return
+			}
+
+			obj, isObject := m.(*msg.Object)
+			if isObject == false {
+				return
+			}
+
+			select {
+			case replies <- reply{obj.Value, true}:
+			default:
+				// someone else already won; drop our reply
+			}
+		}(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(replies)
+	}()
+
+	select {
+	case r, open := <-replies:
+		if open {
+			return r.val, r.ok
+		}
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
@@ -0,0 +1,157 @@
+package node
+
+import (
+	"bytes"
+	"testing"
+
+	skycipher "github.com/skycoin/skycoin/src/cipher"
+)
+
+// TestDeriveSecretsSymmetry checks the core RLPx-style
+// key-schedule property the chunk0-2 fix depends on: given the
+// same ephemeral shared secret and nonces, the initiator and
+// responder must land on matching egress/ingress MACs (each
+// side's egress is the other's ingress) and identical AES
+// secrets, or the two cipherStreams built from them could never
+// talk to each other
+func TestDeriveSecretsSymmetry(t *testing.T) {
+
+	ephemShared := []byte("pretend-ecdh-shared-secret-bytes")
+	nonceInit := newNonce()
+	nonceResp := newNonce()
+
+	init := deriveSecrets(ephemShared, nonceInit, nonceResp, true)
+	resp := deriveSecrets(ephemShared, nonceInit, nonceResp, false)
+
+	if init.aesSecret != resp.aesSecret {
+		t.Fatal("aesSecret differs between initiator and responder")
+	}
+
+	if init.macSecret != resp.macSecret {
+		t.Fatal("macSecret differs between initiator and responder")
+	}
+
+	if init.egressMAC != resp.ingressMAC {
+		t.Fatal("initiator egressMAC must equal responder ingressMAC")
+	}
+
+	if init.ingressMAC != resp.egressMAC {
+		t.Fatal("initiator ingressMAC must equal responder egressMAC")
+	}
+}
+
+// TestCipherStreamSealOpenRoundTrip checks that what one side
+// seals with its egress state, the other side can open with its
+// matching ingress state
+func TestCipherStreamSealOpenRoundTrip(t *testing.T) {
+
+	ephemShared := []byte("another-pretend-shared-secret!!")
+	nonceInit := newNonce()
+	nonceResp := newNonce()
+
+	initCS, err := newCipherStream(deriveSecrets(ephemShared, nonceInit, nonceResp, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respCS, err := newCipherStream(deriveSecrets(ephemShared, nonceInit, nonceResp, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("hello over an authenticated wire")
+
+	sealed := initCS.seal(want)
+
+	got, err := respCS.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("round trip mismatch: got %q, want %q", got, want)
+	}
+}
+
+// TestVerifyHandshakeSig checks the identity-recovery check the
+// chunk0-2 fix relies on in place of the original, broken
+// VerifySignedHash(sig, hash) call: a signature must only verify
+// against the pubkey that actually produced it
+func TestVerifyHandshakeSig(t *testing.T) {
+
+	pub, sec := skycipher.GenerateKeyPair()
+	otherPub, _ := skycipher.GenerateKeyPair()
+
+	hash := keccak256([]byte("handshake transcript"))
+
+	sig, err := skycipher.SignHash(hash, sec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyHandshakeSig(pub, sig, hash); err != nil {
+		t.Fatalf("verifyHandshakeSig should accept the real signer: %v", err)
+	}
+
+	if err := verifyHandshakeSig(otherPub, sig, hash); err == nil {
+		t.Fatal("verifyHandshakeSig should reject a mismatched claimed pubkey")
+	}
+}
+
+// TestHandshakeConfirmProvesInitiatorIdentity checks the
+// chunk0-2 follow-up fix: the ack alone only authenticates the
+// responder, so an initiator that claims a StaticPub it
+// doesn't hold must fail the confirm step rather than have its
+// claimed identity trusted. Exercises the same ECDH/sign/verify
+// primitives initiateHandshake/respondHandshake use, without
+// the network plumbing
+func TestHandshakeConfirmProvesInitiatorIdentity(t *testing.T) {
+
+	respPub, respSec := skycipher.GenerateKeyPair()
+	realInitPub, realInitSec := skycipher.GenerateKeyPair()
+
+	initNonce, respNonce := newNonce(), newNonce()
+
+	// responder's view: computes staticShared from whatever
+	// StaticPub the initiator claims
+	respShared, err := skycipher.ECDH(realInitPub, respSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// genuine initiator: signs the confirm with the secret
+	// matching the StaticPub it actually claimed
+	initShared, err := skycipher.ECDH(respPub, realInitSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(initShared, respShared) {
+		t.Fatal("ECDH should land both sides on the same static-static shared secret")
+	}
+
+	confirmHash := keccak256(respNonce[:], initNonce[:], initShared)
+	sig, err := skycipher.SignHash(confirmHash, realInitSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyHandshakeSig(realInitPub, sig, confirmHash); err != nil {
+		t.Fatalf("genuine initiator's confirm should verify: %v", err)
+	}
+
+	// an attacker claims realInitPub in the init but can only
+	// sign with its own secret: the responder's staticShared
+	// (computed from the claimed pubkey) never matches what the
+	// attacker can actually produce a valid signature for
+	_, attackerSec := skycipher.GenerateKeyPair()
+
+	forgedHash := keccak256(respNonce[:], initNonce[:], respShared)
+	forgedSig, err := skycipher.SignHash(forgedHash, attackerSec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verifyHandshakeSig(realInitPub, forgedSig, forgedHash); err == nil {
+		t.Fatal("an attacker without realInitSec must not pass as realInitPub")
+	}
+}
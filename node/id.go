@@ -0,0 +1,11 @@
+package node
+
+import (
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// A NodeID uniquely identifies a Node on the network. It is
+// the Node's static public key, the same key used by the
+// handshake (see handshake.go) and by the discover package's
+// Kademlia routing table
+type NodeID = cipher.PubKey
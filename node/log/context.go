@@ -0,0 +1,37 @@
+package log
+
+import "context"
+
+// unexported type so the key can't collide with another
+// package's context key
+type ctxKey struct{}
+
+// NewContext returns a copy of parent carrying l, so code
+// further down a call chain can pull the same bound Logger
+// back out with FromContext instead of it being threaded
+// through every function signature
+func NewContext(parent context.Context, l Logger) context.Context {
+	return context.WithValue(parent, ctxKey{}, l)
+}
+
+// FromContext returns the Logger previously attached to ctx
+// by NewContext, or a Logger that discards everything if none
+// was attached
+func FromContext(ctx context.Context) Logger {
+	if l, ok := ctx.Value(ctxKey{}).(Logger); ok {
+		return l
+	}
+	return nopLogger{}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Print(args ...interface{})                          {}
+func (nopLogger) Printf(format string, args ...interface{})          {}
+func (nopLogger) Debug(pin Pin, args ...interface{})                 {}
+func (nopLogger) Debugf(pin Pin, format string, args ...interface{}) {}
+func (nopLogger) With(kv ...interface{}) Logger                      { return nopLogger{} }
+func (nopLogger) Trace(msg string, kv ...interface{})                {}
+func (nopLogger) Info(msg string, kv ...interface{})                 {}
+func (nopLogger) Warn(msg string, kv ...interface{})                 {}
+func (nopLogger) Error(msg string, kv ...interface{})                {}
@@ -0,0 +1,238 @@
+// Package log implements the leveled logger used across
+// node, gnet and data. Besides the historical Print/Printf
+// and Pin-gated Debug/Debugf methods, a Logger carries a
+// small key/value context that accumulates as it's threaded
+// through a request: a Conn binds "addr"/"incoming" once at
+// creation, a feed handler adds "feed", and every Trace/Info/
+// Warn/Error call after that includes them automatically
+// instead of repeating them at every call site
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Pin is a bitmask used to turn categories of Debug output
+// on and off without recompiling
+type Pin uint32
+
+// All matches every Pin
+const All Pin = ^Pin(0)
+
+// A Level is the severity of a structured log entry
+type Level int
+
+// known levels, from least to most severe
+const (
+	TraceLevel Level = iota
+	DebugLevel
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+// String implements the fmt.Stringer interface
+func (l Level) String() string {
+	switch l {
+	case TraceLevel:
+		return "TRACE"
+	case DebugLevel:
+		return "DEBUG"
+	case InfoLevel:
+		return "INFO"
+	case WarnLevel:
+		return "WARN"
+	case ErrorLevel:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// A Format selects how structured entries are rendered
+type Format string
+
+// supported formats
+const (
+	TextFormat Format = "text" // "LEVEL msg key=value ..." lines
+	JSONFormat Format = "json" // one JSON object per line
+)
+
+// A Config represents configurations of a Logger
+type Config struct {
+	Output io.Writer // defaults to os.Stderr
+	Prefix string    // prepended to every plain Print/Printf/Debug line
+
+	Debug bool // enable Pin-gated Debug/Debugf output
+	Pins  Pin  // which pins are enabled when Debug is true
+
+	// Format selects rendering for the structured With/Trace/
+	// Info/Warn/Error API. Empty means TextFormat. There is no
+	// structured Debug: Debug/Debugf are always plain text
+	Format Format
+}
+
+// NewConfig returns a Config filled with default values:
+// stderr output, text format, debug disabled
+func NewConfig() (c Config) {
+	c.Output = os.Stderr
+	c.Format = TextFormat
+	return
+}
+
+// A Logger writes leveled, optionally key/value-annotated
+// messages. With returns a child Logger that prepends extra
+// key/value pairs to every future call on it, letting a Conn
+// or a feed bind its identity once instead of repeating it at
+// every call site
+type Logger interface {
+	// Print and Printf always write, regardless of Debug
+	Print(args ...interface{})
+	Printf(format string, args ...interface{})
+
+	// Debug and Debugf only write if Debug is set and pin is
+	// either All or one of the enabled Pins
+	Debug(pin Pin, args ...interface{})
+	Debugf(pin Pin, format string, args ...interface{})
+
+	// With returns a child Logger carrying kv (alternating
+	// key, value, ...) in addition to any it already has
+	With(kv ...interface{}) Logger
+
+	Trace(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+type logger struct {
+	mx     *sync.Mutex // shared with every child, so lines never interleave
+	out    io.Writer
+	prefix string
+
+	debug bool
+	pins  Pin
+
+	format Format
+	kv     []interface{} // inherited context
+}
+
+// NewLogger creates a Logger from c
+func NewLogger(c Config) Logger {
+	out := c.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	format := c.Format
+	if format == "" {
+		format = TextFormat
+	}
+	return &logger{
+		mx:     new(sync.Mutex),
+		out:    out,
+		prefix: c.Prefix,
+		debug:  c.Debug,
+		pins:   c.Pins,
+		format: format,
+	}
+}
+
+func (l *logger) Print(args ...interface{}) {
+	l.writeLine(fmt.Sprint(args...))
+}
+
+func (l *logger) Printf(format string, args ...interface{}) {
+	l.writeLine(fmt.Sprintf(format, args...))
+}
+
+func (l *logger) Debug(pin Pin, args ...interface{}) {
+	if l.enabled(pin) {
+		l.writeLine(fmt.Sprint(args...))
+	}
+}
+
+func (l *logger) Debugf(pin Pin, format string, args ...interface{}) {
+	if l.enabled(pin) {
+		l.writeLine(fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *logger) enabled(pin Pin) bool {
+	return l.debug && (pin == All || l.pins&pin != 0)
+}
+
+func (l *logger) writeLine(line string) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if l.prefix != "" {
+		io.WriteString(l.out, l.prefix)
+	}
+	io.WriteString(l.out, line)
+	if len(line) == 0 || line[len(line)-1] != '\n' {
+		io.WriteString(l.out, "\n")
+	}
+}
+
+func (l *logger) With(kv ...interface{}) Logger {
+	child := new(logger)
+	*child = *l
+	child.kv = append(append([]interface{}{}, l.kv...), kv...)
+	return child
+}
+
+func (l *logger) Trace(msg string, kv ...interface{}) { l.log(TraceLevel, msg, kv) }
+func (l *logger) Info(msg string, kv ...interface{})  { l.log(InfoLevel, msg, kv) }
+func (l *logger) Warn(msg string, kv ...interface{})  { l.log(WarnLevel, msg, kv) }
+func (l *logger) Error(msg string, kv ...interface{}) { l.log(ErrorLevel, msg, kv) }
+
+func (l *logger) log(level Level, msg string, kv []interface{}) {
+	all := append(append([]interface{}{}, l.kv...), kv...)
+	// Prefix applies to plain Print/Printf/Debug lines only
+	noPrefix := *l
+	noPrefix.prefix = ""
+	if l.format == JSONFormat {
+		noPrefix.writeJSON(level, msg, all)
+		return
+	}
+	noPrefix.writeText(level, msg, all)
+}
+
+func (l *logger) writeText(level Level, msg string, kv []interface{}) {
+	var buf bytes.Buffer
+
+	buf.WriteString(level.String())
+	buf.WriteString(" ")
+	buf.WriteString(msg)
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&buf, " %v=%v", kv[i], kv[i+1])
+	}
+
+	l.writeLine(buf.String())
+}
+
+func (l *logger) writeJSON(level Level, msg string, kv []interface{}) {
+	entry := make(map[string]interface{}, len(kv)/2+2)
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		if key, ok := kv[i].(string); ok {
+			entry[key] = kv[i+1]
+		}
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		l.writeLine(fmt.Sprintf("%s %s (log: %v)", level, msg, err))
+		return
+	}
+	l.writeLine(string(raw))
+}
@@ -0,0 +1,140 @@
+// Package metrics exposes Prometheus instrumentation for a
+// Node: connection counts, message throughput, per-feed byte
+// counters, DB transaction latency and WAL lag. A single
+// Collector is created per Node and its counters/gauges/
+// histograms are updated from the call sites that already know
+// about the event (onConnect, sendMsg/receiving) rather than
+// polled; DB transaction latency and WAL lag are recorded once,
+// in NewNode
+package metrics
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// A Collector holds every metric a Node reports
+type Collector struct {
+	registry *prometheus.Registry
+
+	// Connections is the number of open connections, by
+	// direction: "incoming" or "outgoing"
+	Connections *prometheus.GaugeVec
+
+	// MessagesSent/MessagesReceived count wire messages by
+	// their Go type name (e.g. "*msg.Root")
+	MessagesSent     *prometheus.CounterVec
+	MessagesReceived *prometheus.CounterVec
+
+	// BytesIn/BytesOut count raw bytes, by feed
+	BytesIn  *prometheus.CounterVec
+	BytesOut *prometheus.CounterVec
+
+	// WALLag is how many records have been written to the
+	// WAL since its last checkpoint
+	WALLag prometheus.Gauge
+
+	// DBTxDuration is how long an IdxDB.Tx call took
+	DBTxDuration prometheus.Histogram
+}
+
+// NewCollector creates a Collector and registers every metric
+// with a fresh prometheus.Registry
+func NewCollector() (c *Collector) {
+	c = new(Collector)
+	c.registry = prometheus.NewRegistry()
+
+	c.Connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cxo",
+		Subsystem: "node",
+		Name:      "connections",
+		Help:      "Number of open connections by direction.",
+	}, []string{"direction"})
+
+	c.MessagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cxo",
+		Subsystem: "node",
+		Name:      "messages_sent_total",
+		Help:      "Messages sent, by type.",
+	}, []string{"type"})
+
+	c.MessagesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cxo",
+		Subsystem: "node",
+		Name:      "messages_received_total",
+		Help:      "Messages received, by type.",
+	}, []string{"type"})
+
+	c.BytesIn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cxo",
+		Subsystem: "node",
+		Name:      "bytes_in_total",
+		Help:      "Bytes received, by feed.",
+	}, []string{"feed"})
+
+	c.BytesOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cxo",
+		Subsystem: "node",
+		Name:      "bytes_out_total",
+		Help:      "Bytes sent, by feed.",
+	}, []string{"feed"})
+
+	c.WALLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "cxo",
+		Subsystem: "data",
+		Name:      "wal_lag_records",
+		Help:      "Records written to the WAL since its last checkpoint.",
+	})
+
+	c.DBTxDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "cxo",
+		Subsystem: "data",
+		Name:      "db_tx_duration_seconds",
+		Help:      "Duration of IdxDB.Tx calls.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	c.registry.MustRegister(
+		c.Connections,
+		c.MessagesSent,
+		c.MessagesReceived,
+		c.BytesIn,
+		c.BytesOut,
+		c.WALLag,
+		c.DBTxDuration,
+	)
+
+	return
+}
+
+// ObserveDBTxDuration records how long an IdxDB.Tx call took
+func (c *Collector) ObserveDBTxDuration(d time.Duration) {
+	c.DBTxDuration.Observe(d.Seconds())
+}
+
+// Handler returns the http.Handler that serves /metrics
+func (c *Collector) Handler() http.Handler {
+	return promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{})
+}
+
+// NewServer builds the http.Server that serves /metrics (from
+// c) and /debug/pprof/* (the runtime profiler) on address.
+// The caller is responsible for calling ListenAndServe (in a
+// goroutine) and for shutting it down again
+func NewServer(address string, c *Collector) *http.Server {
+	mux := http.NewServeMux()
+
+	mux.Handle("/metrics", c.Handler())
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &http.Server{Addr: address, Handler: mux}
+}
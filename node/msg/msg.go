@@ -0,0 +1,216 @@
+// Package msg represents the wire protocol spoken between
+// Node instances. Every message implements the Msg interface
+// and is registered under a unique Type byte that is written
+// as a single-byte prefix before the message's encoded body,
+// so that Decode can recover the concrete Go type of any raw
+// messege received over a Conn
+package msg
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/skycoin/skycoin/src/cipher"
+	"github.com/skycoin/skycoin/src/cipher/encoder"
+)
+
+// A Type represents type of a Msg. It is
+// sent over the wire as a single byte
+type Type byte
+
+// known message types
+const (
+	ErrType Type = 1 + iota
+	OkType
+
+	SubType
+	UnsubType
+
+	RqListType
+	ListType
+
+	RootType
+
+	RqObjectType
+	ObjectType
+
+	RqPreviewType
+)
+
+// A Msg in common interface of all messages
+// exchanged between Node instances
+type Msg interface {
+	// Type of the Msg, used to encode/decode it
+	Type() Type
+}
+
+// registered message types
+var reg = map[Type]reflect.Type{}
+
+// Register associates given Type with the Go type of given
+// Msg. It panics on a duplicate Type, since that can only be
+// a programmer error (two messages sharing one wire tag), not
+// a runtime condition
+func Register(t Type, m Msg) {
+	if _, ok := reg[t]; ok {
+		panic(fmt.Sprintf("msg: type %d already registered", t))
+	}
+	reg[t] = reflect.TypeOf(m).Elem()
+}
+
+func init() {
+	Register(ErrType, &Err{})
+	Register(OkType, &Ok{})
+
+	Register(SubType, &Sub{})
+	Register(UnsubType, &Unsub{})
+
+	Register(RqListType, &RqList{})
+	Register(ListType, &List{})
+
+	Register(RootType, &Root{})
+
+	Register(RqObjectType, &RqObject{})
+	Register(ObjectType, &Object{})
+
+	Register(RqPreviewType, &RqPreview{})
+}
+
+// Encode given Msg prefixing its encoded body
+// with the Msg's Type byte
+func Encode(m Msg) (raw []byte) {
+	var body = encoder.Serialize(m)
+	raw = make([]byte, 1, 1+len(body))
+	raw[0] = byte(m.Type())
+	return append(raw, body...)
+}
+
+// Decode raw bytes (encoded by Encode) back into
+// the concrete Msg they represent
+func Decode(raw []byte) (m Msg, err error) {
+	if len(raw) == 0 {
+		err = fmt.Errorf("msg: empty messege")
+		return
+	}
+
+	var t = Type(raw[0])
+
+	rt, ok := reg[t]
+	if ok == false {
+		err = fmt.Errorf("msg: unknown messege type %d", t)
+		return
+	}
+
+	var val = reflect.New(rt)
+	if err = encoder.DeserializeRaw(raw[1:], val.Interface()); err != nil {
+		return
+	}
+
+	m = val.Interface().(Msg)
+	return
+}
+
+//
+// core messages
+//
+
+// An Err is response that represents an error
+type Err struct {
+	Err string
+}
+
+// Type implements the Msg interface
+func (*Err) Type() Type { return ErrType }
+
+// An Ok is response for requests that requries
+// no other reply
+type Ok struct{}
+
+// Type implements the Msg interface
+func (*Ok) Type() Type { return OkType }
+
+// A Sub is request to subscribe to a feed
+type Sub struct {
+	Feed cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*Sub) Type() Type { return SubType }
+
+// An Unsub notifies remote peer that this
+// node unsubscribes from given feed. It has
+// no reply
+type Unsub struct {
+	Feed cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*Unsub) Type() Type { return UnsubType }
+
+// An RqList is request for list of feeds a
+// public server shares
+type RqList struct{}
+
+// Type implements the Msg interface
+func (*RqList) Type() Type { return RqListType }
+
+// A List is reply for the RqList
+type List struct {
+	Feeds []cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*List) Type() Type { return ListType }
+
+// A Root is push of a Root object of a feed. It
+// carries encoded Root and its signature, so a
+// receiver can verify and decode it. Round tags which
+// consensus round (see node/consensus) this push stands
+// for: the publisher of a new Root always uses round 0,
+// but a BFT proposer re-pushing the same Root after an
+// earlier round timed out sets Round to the round it is
+// now proposing for, so the receiver's Reactor can check
+// it against the right round's proposer instead of
+// always assuming round 0
+type Root struct {
+	Feed  cipher.PubKey
+	Nonce uint64
+	Seq   uint64
+	Round uint64
+
+	Value []byte
+	Sig   cipher.Sig
+}
+
+// Type implements the Msg interface
+func (*Root) Type() Type { return RootType }
+
+// An RqObject is request for a single object by its
+// hash. Prefetch lists hashes the requester already
+// knows it will want next (e.g. children of an HArray
+// node); the receiving node does not act on it
+type RqObject struct {
+	Key      cipher.SHA256
+	Prefetch []cipher.SHA256
+}
+
+// Type implements the Msg interface
+func (*RqObject) Type() Type { return RqObjectType }
+
+// An Object is reply for the RqObject (and for
+// entries of an RqObjects batch)
+type Object struct {
+	Value []byte
+}
+
+// Type implements the Msg interface
+func (*Object) Type() Type { return ObjectType }
+
+// An RqPreview is request for latest Root of
+// a feed without subscribing to it
+type RqPreview struct {
+	Feed cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*RqPreview) Type() Type { return RqPreviewType }
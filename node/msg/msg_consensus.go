@@ -0,0 +1,57 @@
+package msg
+
+import (
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// consensus round messages, used by the node/consensus
+// Reactor to agree on which Root becomes the committed head
+// of a (feed, nonce) before it is surfaced to onRoot
+const (
+	ProposalType Type = 24 + iota
+	PrevoteType
+	PrecommitType
+)
+
+func init() {
+	Register(ProposalType, &Proposal{})
+	Register(PrevoteType, &Prevote{})
+	Register(PrecommitType, &Precommit{})
+}
+
+// A Proposal nominates a Root as the value for given round
+// of consensus on a (feed, nonce) head
+type Proposal struct {
+	Feed  cipher.PubKey
+	Nonce uint64
+	Round uint64
+	Root  cipher.SHA256
+}
+
+// Type implements the Msg interface
+func (*Proposal) Type() Type { return ProposalType }
+
+// A Prevote is a voter's first-phase vote for a round. A
+// zero Root is a nil vote (the voter doesn't prevote for
+// anything this round, e.g. it never saw a Proposal)
+type Prevote struct {
+	Feed  cipher.PubKey
+	Nonce uint64
+	Round uint64
+	Root  cipher.SHA256
+}
+
+// Type implements the Msg interface
+func (*Prevote) Type() Type { return PrevoteType }
+
+// A Precommit is a voter's second-phase vote, cast once it
+// has seen 2/3+ matching Prevotes for a Root in this round
+type Precommit struct {
+	Feed  cipher.PubKey
+	Nonce uint64
+	Round uint64
+	Root  cipher.SHA256
+}
+
+// Type implements the Msg interface
+func (*Precommit) Type() Type { return PrecommitType }
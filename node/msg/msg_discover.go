@@ -0,0 +1,60 @@
+package msg
+
+import (
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// Kademlia-style provider discovery messages, used by the
+// node/discover package to find peers for a feed without
+// relying on a hard-coded public server
+const (
+	RqFindNodeType Type = 20 + iota
+	NodesType
+	RqProvidersType
+	ProvidersType
+)
+
+func init() {
+	Register(RqFindNodeType, &RqFindNode{})
+	Register(NodesType, &Nodes{})
+	Register(RqProvidersType, &RqProviders{})
+	Register(ProvidersType, &Providers{})
+}
+
+// An RqFindNode asks the peer for the NodeIDs (static
+// public keys) closest to Target that it knows about
+type RqFindNode struct {
+	Target cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*RqFindNode) Type() Type { return RqFindNodeType }
+
+// A Nodes is reply for RqFindNode: the addresses of the
+// closest NodeIDs the peer knows, paired up so the caller
+// can dial them directly
+type Nodes struct {
+	IDs       []cipher.PubKey
+	Addresses []string
+}
+
+// Type implements the Msg interface
+func (*Nodes) Type() Type { return NodesType }
+
+// An RqProviders asks the peer which NodeIDs it believes
+// provide (share) given feed
+type RqProviders struct {
+	Feed cipher.PubKey
+}
+
+// Type implements the Msg interface
+func (*RqProviders) Type() Type { return RqProvidersType }
+
+// A Providers is reply for RqProviders
+type Providers struct {
+	IDs       []cipher.PubKey
+	Addresses []string
+}
+
+// Type implements the Msg interface
+func (*Providers) Type() Type { return ProvidersType }
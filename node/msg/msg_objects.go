@@ -0,0 +1,45 @@
+package msg
+
+import (
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// batch object request/reply, added alongside the
+// single-object RqObject/Object pair so a peer that
+// doesn't understand a batch can still be served by
+// the old path
+const (
+	RqObjectsType Type = 11 + iota
+	ObjectsType
+)
+
+func init() {
+	Register(RqObjectsType, &RqObjects{})
+	Register(ObjectsType, &Objects{})
+}
+
+// An RqObjects is request for many objects by their
+// hashes in one round trip, sent by node.Wantlist so a
+// batch of keys costs one request instead of one RqObject
+// per key. If the reply is not an Objects with one value
+// per key (e.g. an old version), the Wantlist retries each
+// key with an individual RqObject; a request that fails or
+// gets no reply is not retried
+type RqObjects struct {
+	Keys []cipher.SHA256
+}
+
+// Type implements the Msg interface
+func (*RqObjects) Type() Type { return RqObjectsType }
+
+// An Objects is reply for the RqObjects. Values are
+// in the same order as the requested Keys; a missing
+// object is represented by a nil slice at its index so
+// the receiver can tell "don't have it" apart from
+// "haven't replied yet"
+type Objects struct {
+	Values [][]byte
+}
+
+// Type implements the Msg interface
+func (*Objects) Type() Type { return ObjectsType }
@@ -1,7 +1,9 @@
 package node
 
 import (
+	"context"
 	"errors"
+	"net/http"
 	"path/filepath"
 	"sync"
 	"time"
@@ -13,10 +15,14 @@ import (
 	"github.com/skycoin/cxo/data"
 	"github.com/skycoin/cxo/data/cxds"
 	"github.com/skycoin/cxo/data/idxdb"
+	"github.com/skycoin/cxo/data/wal"
 	"github.com/skycoin/cxo/skyobject"
 
+	"github.com/skycoin/cxo/node/consensus"
+	"github.com/skycoin/cxo/node/discover"
 	"github.com/skycoin/cxo/node/gnet"
 	"github.com/skycoin/cxo/node/log"
+	"github.com/skycoin/cxo/node/metrics"
 	"github.com/skycoin/cxo/node/msg"
 )
 
@@ -40,6 +46,9 @@ var (
 	ErrConnClsoed = errors.New("connection closed")
 	// ErrUnsubscribed is a reason of dropping a filling Root
 	ErrUnsubscribed = errors.New("unsubscribed")
+	// ErrNoProviders occurs if Subscribe can't find any peer
+	// that shares the requested feed and has a dialable address
+	ErrNoProviders = errors.New("no providers found for feed")
 )
 
 // A Node represents CXO P2P node
@@ -66,10 +75,21 @@ type Node struct {
 	wmx sync.Mutex
 	wos map[cipher.SHA256]map[*Conn]struct{}
 
+	// in-flight GetObjects/HasObject requests, keyed by
+	// object hash, so concurrent callers share one broadcast
+	imx      sync.Mutex
+	inflight map[cipher.SHA256]*inflightFetch
+
 	// connections
 	pool *gnet.Pool
 	rpc  *rpcServer // rpc server
 
+	// metrics is the Prometheus Collector for this Node;
+	// metricsSrv, set only when Config.MetricsAddress is
+	// non-empty, serves it plus /debug/pprof/* until Close
+	metrics    *metrics.Collector
+	metricsSrv *http.Server
+
 	// closing
 	quit  chan struct{}
 	quito sync.Once
@@ -80,6 +100,32 @@ type Node struct {
 	await sync.WaitGroup
 
 	discovery *factory.MessengerFactory
+
+	// kad is the Kademlia provider-discovery table, used to
+	// find peers for a feed without a known public server.
+	// Share announces this Node as a provider on it; Subscribe
+	// falls back to it when no Conn already has the feed
+	kad *discover.Table
+
+	// amx guards addrs, this Node's address book: dialable
+	// addresses for NodeIDs it has learned about, either from
+	// its own Conns completing a handshake or from Nodes/
+	// Providers replies. kad only ever deals in NodeIDs; this
+	// is what lets Subscribe turn one back into something it
+	// can s.Connect to
+	amx   sync.RWMutex
+	addrs map[cipher.PubKey]string
+
+	// rmx guards reactor, which decides whether a Root
+	// received by handleRoot is committed and so surfaced to
+	// onRoot. Defaults to consensus.NoopReactor{}, reproducing
+	// the historical "accept any Root with Seq > last" rule
+	rmx     sync.RWMutex
+	reactor consensus.Reactor
+
+	// persistent is the set of peers the Node keeps redialing
+	// with backoff after a disconnect (see persistent.go)
+	persistent *persistentPeers
 }
 
 // NewNode creates new Node instnace using given
@@ -132,6 +178,24 @@ func NewNode(sc Config) (s *Node, err error) {
 			cx.Close()
 			return
 		}
+
+		every, period := sc.WALCheckpointRecords, sc.WALCheckpointPeriod
+		if every <= 0 {
+			every = DefaultWALCheckpointRecords
+		}
+		if period <= 0 {
+			period = DefaultWALCheckpointPeriod
+		}
+
+		walIdx, werr := data.NewWALIdxDB(idx, idxPath+".wal", every, period)
+		if werr != nil {
+			err = werr
+			idx.Close()
+			cx.Close()
+			return
+		}
+		idx = walIdx
+
 		db = data.NewDB(cx, idx)
 	}
 
@@ -153,14 +217,53 @@ func NewNode(sc Config) (s *Node, err error) {
 	s.feeds = make(map[cipher.PubKey]map[*Conn]struct{})
 
 	s.wos = make(map[cipher.SHA256]map[*Conn]struct{})
+	s.inflight = make(map[cipher.SHA256]*inflightFetch)
+
+	// no static identity configured: generate one for the
+	// lifetime of the process
+	if s.conf.StaticSecretKey == (cipher.SecKey{}) {
+		s.conf.StaticPublicKey, s.conf.StaticSecretKey = cipher.GenerateKeyPair()
+	}
+
+	s.kad = discover.NewTable(s.conf.StaticPublicKey)
+	s.kad.SetRefresher(s)
+	s.addrs = make(map[cipher.PubKey]string)
+	s.reactor = consensus.NoopReactor{}
+
+	s.metrics = metrics.NewCollector()
+
+	// replay whatever the WAL holds after an unsafe close; a
+	// no-op if the IdxDB isn't WAL-wrapped or closed safely
+	// last time
+	err = s.db.IdxDB().Recover(func(r *wal.Record) (err error) {
+		s.Info("replaying WAL record", "reqNum", r.ReqNum, "op", r.Op, "feed", r.Feed)
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		s = nil
+		return
+	}
+
+	s.persistent = newPersistentPeers(s)
+	if err = s.persistent.load(); err != nil {
+		db.Close()
+		s = nil
+		return
+	}
 
 	// fill up feeds from database
+	txStart := time.Now()
 	err = s.db.IdxDB().Tx(func(feeds data.Feeds) (err error) {
 		return feeds.Iterate(func(pk cipher.PubKey) (err error) {
 			s.feeds[pk] = make(map[*Conn]struct{})
 			return
 		})
 	})
+	s.metrics.ObserveDBTxDuration(time.Since(txStart))
+	if wl, ok := s.db.IdxDB().(interface{ WALLag() int }); ok {
+		s.metrics.WALLag.Set(float64(wl.WALLag()))
+	}
 	if err != nil {
 		db.Close() // close DB
 		s = nil    // GC
@@ -220,79 +323,43 @@ func NewNode(sc Config) (s *Node, err error) {
 }
 
 func (s *Node) start(cxPath, idxPath string) (err error) {
-	s.Debugf(log.All, `starting node:
-    data dir:             %s
-
-    max connections:      %d
-    max message size:     %d
-
-    dial timeout:         %v
-    read timeout:         %v
-    write timeout:        %v
-
-    ping interval:        %v
+	s.Info("starting node",
+		"data dir", s.conf.DataDir,
 
-    read queue:           %d
-    write queue:          %d
+		"max connections", s.conf.MaxConnections,
+		"max message size", s.conf.MaxMessageSize,
 
-    redial timeout:       %d
-    max redial timeout:   %d
-    dials limit:          %d
+		"dial timeout", s.conf.DialTimeout,
+		"read timeout", s.conf.ReadTimeout,
+		"write timeout", s.conf.WriteTimeout,
 
-    read buffer:          %d
-    write buffer:         %d
+		"ping interval", s.conf.PingInterval,
 
-    TLS:                  %v
+		"read queue", s.conf.ReadQueueLen,
+		"write queue", s.conf.WriteQueueLen,
 
-    enable RPC:           %v
-    RPC address:          %s
-    listening address:    %s
-    enable listening:     %v
-    remote close:         %t
+		"redial timeout", s.conf.RedialTimeout,
+		"max redial timeout", s.conf.MaxRedialTimeout,
+		"dials limit", s.conf.DialsLimit,
 
-    in-memory DB:         %v
-    CXDS path:            %s
-    index DB path:        %s
+		"read buffer", s.conf.ReadBufferSize,
+		"write buffer", s.conf.WriteBufferSize,
 
-    discovery:            %s
+		"tls", s.conf.TLSConfig != nil,
 
-    debug:                %#v
-`,
-		s.conf.DataDir,
-		s.conf.MaxConnections,
-		s.conf.MaxMessageSize,
+		"enable rpc", s.conf.EnableRPC,
+		"rpc address", s.conf.RPCAddress,
+		"listening address", s.conf.Listen,
+		"enable listening", s.conf.EnableListener,
+		"remote close", s.conf.RemoteClose,
 
-		s.conf.DialTimeout,
-		s.conf.ReadTimeout,
-		s.conf.WriteTimeout,
+		"in-memory db", s.conf.InMemoryDB,
+		"cxds path", cxPath,
+		"index db path", idxPath,
 
-		s.conf.PingInterval,
+		"discovery", s.conf.DiscoveryAddresses.String(),
 
-		s.conf.ReadQueueLen,
-		s.conf.WriteQueueLen,
-
-		s.conf.RedialTimeout,
-		s.conf.MaxRedialTimeout,
-		s.conf.DialsLimit,
-
-		s.conf.ReadBufferSize,
-		s.conf.WriteBufferSize,
-
-		s.conf.TLSConfig != nil,
-
-		s.conf.EnableRPC,
-		s.conf.RPCAddress,
-		s.conf.Listen,
-		s.conf.EnableListener,
-		s.conf.RemoteClose,
-
-		s.conf.InMemoryDB,
-		cxPath,
-		idxPath,
-
-		s.conf.DiscoveryAddresses.String(),
-
-		s.conf.Log.Debug,
+		"debug", s.conf.Log.Debug,
 	)
 
 	if len(s.conf.DiscoveryAddresses) > 0 {
@@ -314,7 +381,7 @@ func (s *Node) start(cxPath, idxPath string) (err error) {
 		if err = s.pool.Listen(s.conf.Listen); err != nil {
 			return
 		}
-		s.Print("listen on ", s.pool.Address())
+		s.Info("listen", "address", s.pool.Address())
 	}
 
 	// start rpc listener if need
@@ -323,7 +390,19 @@ func (s *Node) start(cxPath, idxPath string) (err error) {
 			s.pool.Close()
 			return
 		}
-		s.Print("rpc listen on ", s.rpc.Address())
+		s.Info("rpc listen", "address", s.rpc.Address())
+	}
+
+	// start metrics/pprof listener if configured
+	if s.conf.MetricsAddress != "" {
+		s.metricsSrv = metrics.NewServer(s.conf.MetricsAddress, s.metrics)
+		go func() {
+			if err := s.metricsSrv.ListenAndServe(); err != nil &&
+				err != http.ErrServerClosed {
+				s.Error("metrics server error", "err", err)
+			}
+		}()
+		s.Info("metrics listen", "address", s.conf.MetricsAddress)
 	}
 
 	if s.conf.PingInterval > 0 {
@@ -331,6 +410,10 @@ func (s *Node) start(cxPath, idxPath string) (err error) {
 		go s.pingsLoop()
 	}
 
+	for _, address := range s.persistent.List() {
+		go s.persistent.redial(address)
+	}
+
 	return
 }
 
@@ -460,6 +543,11 @@ func (s *Node) Close() (err error) {
 	s.quito.Do(func() {
 		close(s.quit)
 	})
+	s.kad.Close()
+	s.persistent.Close()
+	if s.metricsSrv != nil {
+		s.metricsSrv.Close()
+	}
 	err = s.pool.Close()
 	if s.conf.EnableRPC {
 		s.rpc.Close()
@@ -562,7 +650,8 @@ func (s *Node) delConnFromFeed(c *Conn, pk cipher.PubKey) (deleted bool) {
 }
 
 func (s *Node) onConnect(gc *gnet.Conn) {
-	s.Debugf(ConnPin, "[%s] new connection %t", gc.Address(), gc.IsIncoming())
+	s.Trace("new connection", "addr", gc.Address(), "incoming", gc.IsIncoming())
+	s.metrics.Connections.WithLabelValues(directionLabel(gc.IsIncoming())).Inc()
 
 	if gc.IsIncoming() {
 
@@ -577,7 +666,18 @@ func (s *Node) onConnect(gc *gnet.Conn) {
 }
 
 func (s *Node) onDisconnect(gc *gnet.Conn) {
-	s.Debugf(ConnPin, "[%s] close connection %t", gc.Address(), gc.IsIncoming())
+	s.Trace("close connection", "addr", gc.Address(), "incoming", gc.IsIncoming())
+	s.metrics.Connections.WithLabelValues(directionLabel(gc.IsIncoming())).Dec()
+	s.persistent.onDisconnect(gc.Address())
+}
+
+// directionLabel returns the Prometheus label value for a
+// connection's direction
+func directionLabel(incoming bool) string {
+	if incoming {
+		return "incoming"
+	}
+	return "outgoing"
 }
 
 func (s *Node) onDial(gc *gnet.Conn, _ error) (_ error) {
@@ -678,6 +778,205 @@ func (s *Node) AddFeed(pk cipher.PubKey) (err error) {
 		s.feeds[pk] = make(map[*Conn]struct{})
 		s.feedsl = nil // clear cow copy
 		updateServiceDiscovery(s)
+		s.kad.Provide(pk) // announce: we share this feed now
+		s.feedLogger(pk).Info("added feed")
+	}
+	return
+}
+
+// feedLogger returns a Logger bound with the given feed's
+// public key, so everything logged about that feed can be
+// filtered or correlated without repeating the key at every
+// call site
+func (s *Node) feedLogger(pk cipher.PubKey) log.Logger {
+	return s.With("feed", pk)
+}
+
+// SetReactor replaces the consensus Reactor used to decide
+// whether a Root received over any Conn becomes committed.
+// Substitute a PoA reactor, a raft reactor, or
+// consensus.NoopReactor{} (the default) to get back the
+// historical "trust any newer Root" behavior. The previous
+// reactor is stopped and the new one started
+func (s *Node) SetReactor(r consensus.Reactor) (err error) {
+	s.rmx.Lock()
+	defer s.rmx.Unlock()
+
+	if err = r.Start(); err != nil {
+		return
+	}
+
+	if s.reactor != nil {
+		s.reactor.Stop()
+	}
+	s.reactor = r
+	return
+}
+
+// Reactor returns the consensus Reactor currently in use
+func (s *Node) Reactor() (r consensus.Reactor) {
+	s.rmx.RLock()
+	defer s.rmx.RUnlock()
+	return s.reactor
+}
+
+// BroadcastVote implements consensus.Broadcaster: it sends
+// a consensus messege of given kind to every Conn subscribed
+// to head.Feed, the same population a Root push goes to
+func (s *Node) BroadcastVote(head consensus.Head, kind consensus.VoteKind, v consensus.Vote) {
+	s.fmx.RLock()
+	defer s.fmx.RUnlock()
+
+	for c := range s.feeds[head.Feed] {
+		c.sendVote(head, kind, v)
+	}
+}
+
+// AddPersistentPeer marks address as persistent: the Node
+// dials it immediately and keeps redialing with capped
+// exponential backoff whenever the connection drops, until
+// RemovePersistentPeer is called. The set survives restarts,
+// persisted under Config.DataDir/peers.json. The RPC server
+// does not expose Add/RemovePersistentPeer or PersistentPeers;
+// the set is managed through these Node methods only
+func (s *Node) AddPersistentPeer(address string) (err error) {
+	return s.persistent.Add(address)
+}
+
+// RemovePersistentPeer unmarks address as persistent,
+// stopping future redials. It does not close an
+// already-established connection to it
+func (s *Node) RemovePersistentPeer(address string) (err error) {
+	return s.persistent.Remove(address)
+}
+
+// PersistentPeers lists addresses currently marked
+// persistent
+func (s *Node) PersistentPeers() (addresses []string) {
+	return s.persistent.List()
+}
+
+// FindProviders looks up, via the Kademlia discovery table,
+// peers that are known to share given feed. It does not
+// dial them; callers (e.g. a Subscribe that found no Conn
+// already sharing the feed) are expected to call s.Connect
+// on addresses they obtain by following up with RqFindNode/
+// RqProviders against the returned NodeIDs
+func (s *Node) FindProviders(
+	ctx context.Context,
+	feed cipher.PubKey,
+	max int,
+) <-chan NodeID {
+	return s.kad.FindProvidersAsync(ctx, feed, max)
+}
+
+// RefreshBucket implements discover.Refresher: it asks every
+// current connection for the NodeIDs it knows closest to
+// target, which is how a stale bucket actually gets refreshed
+// instead of just having its seen timestamp bumped. Best-
+// effort and fire-and-forget, like the rest of the discovery
+// queries this drives off of
+func (s *Node) RefreshBucket(ctx context.Context, target cipher.PubKey) {
+	for _, c := range s.Connections() {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		c.queryFindNode(target)
+	}
+}
+
+// rememberAddr records a dialable address for id, so a later
+// FindProviders/Subscribe can turn the bare NodeID it gets
+// back into somewhere to s.Connect
+func (s *Node) rememberAddr(id cipher.PubKey, address string) {
+	if address == "" {
+		return
+	}
+	s.amx.Lock()
+	s.addrs[id] = address
+	s.amx.Unlock()
+}
+
+// addrFor looks up a dialable address remembered for id
+func (s *Node) addrFor(id cipher.PubKey) (address string, ok bool) {
+	s.amx.RLock()
+	address, ok = s.addrs[id]
+	s.amx.RUnlock()
+	return
+}
+
+// resolvableNodes filters ids down to the ones this Node has
+// a dialable address for (itself included), pairing each one
+// up with its address, the way msg.Nodes/msg.Providers expect
+func (s *Node) resolvableNodes(ids []cipher.PubKey) (kept []cipher.PubKey, addrs []string) {
+	for _, id := range ids {
+		if id == s.conf.StaticPublicKey {
+			kept = append(kept, id)
+			addrs = append(addrs, s.pool.Address())
+			continue
+		}
+		if address, ok := s.addrFor(id); ok {
+			kept = append(kept, id)
+			addrs = append(addrs, address)
+		}
+	}
+	return
+}
+
+// Subscribe makes FindProviders actually transparent: unlike
+// a bare Conn.Subscribe (which requires an already-established
+// Conn), this finds one itself. If an existing Conn already
+// shares feed, it subscribes there; otherwise it asks every
+// current Conn who else provides feed (widening the address
+// book), then walks the Kademlia table's view of feed's
+// providers, dialing and subscribing to the first one it can
+// reach. Candidates FindProviders yields through its fallback-
+// to-closest path (merely near feed's key, not confirmed
+// providers) rarely have a remembered address yet; for those,
+// an RqFindNode round trip against existing connections is
+// tried before giving up on the candidate
+func (s *Node) Subscribe(ctx context.Context, feed cipher.PubKey) (err error) {
+
+	for _, c := range s.Connections() {
+		for _, f := range c.Feeds() {
+			if f == feed {
+				return c.Subscribe(feed)
+			}
+		}
+	}
+
+	for _, c := range s.Connections() {
+		c.queryProviders(feed)
+	}
+
+	for id := range s.FindProviders(ctx, feed, 8) {
+
+		if id == s.conf.StaticPublicKey {
+			continue // that's us
+		}
+
+		address, ok := s.addrFor(id)
+		if !ok {
+			for _, c := range s.Connections() {
+				c.queryFindNode(id)
+			}
+			if address, ok = s.addrFor(id); !ok {
+				continue // still no dialable address
+			}
+		}
+
+		var c *Conn
+		if c, err = s.Connect(address); err != nil {
+			continue // try the next provider
+		}
+
+		return c.Subscribe(feed)
+	}
+
+	if err == nil {
+		err = ErrNoProviders
 	}
 	return
 }
@@ -765,14 +1064,23 @@ func (s *Node) DelFeed(pk cipher.PubKey) (err error) {
 	return
 }
 
-/*
-// Stat of underlying DB and Container
-func (s *Node) Stat() (st Stat) {
-	st.Data = s.DB().Stat()
+// A Stat is a combined snapshot of the underlying DB and
+// Container statistics, returned by Node.Stat. The RPC server
+// has no Stats method; the struct is available through
+// Node.Stat only
+type Stat struct {
+	Data data.Stat      // DB: IdxDB shape plus CXDS object counts
+	CXO  skyobject.Stat // Container: cache effectiveness, in-flight fills
+}
+
+// Stat returns a snapshot of the underlying DB and Container
+func (s *Node) Stat() (st Stat, err error) {
+	if st.Data, err = s.DB().Stat(); err != nil {
+		return
+	}
 	st.CXO = s.Container().Stat()
 	return
 }
-*/
 
 func maxDuration(a, b time.Duration) time.Duration {
 	if a > b {
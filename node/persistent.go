@@ -0,0 +1,259 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// peersFileName is where the persistent peer registry is
+// stored inside Config.DataDir, so it survives restarts
+const peersFileName = "peers.json"
+
+// a persistentPeer tracks one address marked persistent:
+// the feeds it was last subscribed to (so they can be
+// replayed after a successful re-handshake) and the current
+// redial backoff state
+type persistentPeer struct {
+	Address string
+	Feeds   []cipher.PubKey `json:"Feeds,omitempty"`
+
+	backoff time.Duration // current redial delay, grows on every failure
+}
+
+// persistentPeers is the in-memory registry of addresses the
+// Node should keep connected to, redialing with capped
+// exponential backoff whenever the connection is lost. It is
+// persisted to Config.DataDir/peers.json so a restart
+// restores the set
+type persistentPeers struct {
+	n *Node
+
+	mx    sync.Mutex
+	peers map[string]*persistentPeer
+
+	quit chan struct{}
+	once sync.Once
+}
+
+func newPersistentPeers(n *Node) (pp *persistentPeers) {
+	pp = new(persistentPeers)
+	pp.n = n
+	pp.peers = make(map[string]*persistentPeer)
+	pp.quit = make(chan struct{})
+	return
+}
+
+func (pp *persistentPeers) path() string {
+	if pp.n.conf.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(pp.n.conf.DataDir, peersFileName)
+}
+
+// load restores the registry from disk. A missing file is
+// not an error: there's simply nothing persisted yet
+func (pp *persistentPeers) load() (err error) {
+	path := pp.path()
+	if path == "" {
+		return
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	var list []persistentPeer
+	if err = json.Unmarshal(data, &list); err != nil {
+		return
+	}
+
+	pp.mx.Lock()
+	defer pp.mx.Unlock()
+
+	for i := range list {
+		pp.peers[list[i].Address] = &list[i]
+	}
+	return
+}
+
+// save persists the registry to disk. Called after every
+// Add/Remove so a crash doesn't lose the set
+func (pp *persistentPeers) save() (err error) {
+	path := pp.path()
+	if path == "" {
+		return
+	}
+
+	pp.mx.Lock()
+	list := make([]persistentPeer, 0, len(pp.peers))
+	for _, p := range pp.peers {
+		list = append(list, persistentPeer{Address: p.Address, Feeds: p.Feeds})
+	}
+	pp.mx.Unlock()
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a temp file in the same
+// directory as path and renames it into place, so a crash
+// mid-write can never leave peers.json truncated
+func writeFileAtomic(path string, data []byte) (err error) {
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// Add marks address as persistent and kicks off an immediate
+// dial attempt. Adding an address twice is a no-op
+func (pp *persistentPeers) Add(address string) (err error) {
+	pp.mx.Lock()
+	if _, ok := pp.peers[address]; ok {
+		pp.mx.Unlock()
+		return nil
+	}
+	pp.peers[address] = &persistentPeer{Address: address, backoff: pp.n.conf.RedialTimeout}
+	pp.mx.Unlock()
+
+	if err = pp.save(); err != nil {
+		return
+	}
+
+	go pp.redial(address)
+	return
+}
+
+// Remove unmarks address as persistent. It does not close an
+// already-established connection, only stops future redials
+func (pp *persistentPeers) Remove(address string) (err error) {
+	pp.mx.Lock()
+	delete(pp.peers, address)
+	pp.mx.Unlock()
+
+	return pp.save()
+}
+
+// List returns the addresses currently marked persistent
+func (pp *persistentPeers) List() (addresses []string) {
+	pp.mx.Lock()
+	defer pp.mx.Unlock()
+
+	addresses = make([]string, 0, len(pp.peers))
+	for addr := range pp.peers {
+		addresses = append(addresses, addr)
+	}
+	return
+}
+
+// rememberFeeds records which feeds were subscribed through
+// a persistent peer, so redial can Subscribe to each of them
+// again once the peer is back
+func (pp *persistentPeers) rememberFeeds(address string, feeds []cipher.PubKey) {
+	pp.mx.Lock()
+	defer pp.mx.Unlock()
+
+	if p, ok := pp.peers[address]; ok {
+		p.Feeds = feeds
+	}
+}
+
+// onDisconnect is wired into Node.onDisconnect; if the
+// closed connection's address is one of ours, it starts the
+// backoff redial loop for it
+func (pp *persistentPeers) onDisconnect(address string) {
+	pp.mx.Lock()
+	_, ok := pp.peers[address]
+	pp.mx.Unlock()
+
+	if ok {
+		go pp.redial(address)
+	}
+}
+
+// redial retries Connect against address with capped
+// exponential backoff and jitter, stopping as soon as either
+// the Node is closing or the address has been removed from
+// the registry
+func (pp *persistentPeers) redial(address string) {
+
+	initial := pp.n.conf.RedialTimeout
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := pp.n.conf.MaxRedialTimeout
+	if max <= 0 {
+		max = 2 * time.Minute
+	}
+
+	for {
+		pp.mx.Lock()
+		p, ok := pp.peers[address]
+		if ok && p.backoff <= 0 {
+			p.backoff = initial
+		}
+		pp.mx.Unlock()
+		if ok == false {
+			return // no longer persistent
+		}
+
+		c, err := pp.n.Connect(address)
+		if err == nil {
+			// success: reset backoff and replay the specific
+			// feeds this peer was subscribed to before the drop
+			pp.mx.Lock()
+			p.backoff = initial
+			feeds := append([]cipher.PubKey(nil), p.Feeds...)
+			pp.mx.Unlock()
+
+			for _, feed := range feeds {
+				// ignore error: a partial replay beats dropping
+				// the rest of the feeds over one bad Subscribe
+				c.Subscribe(feed)
+			}
+
+			return
+		}
+
+		pp.mx.Lock()
+		delay := p.backoff
+		p.backoff *= 2
+		if p.backoff > max {
+			p.backoff = max
+		}
+		pp.mx.Unlock()
+
+		select {
+		case <-time.After(jitter(delay)):
+		case <-pp.quit:
+			return
+		}
+	}
+}
+
+// jitter returns d plus up to 20% random variation, so many
+// persistent peers reconnecting at once don't all hammer the
+// remote at the exact same instant
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration(rand.Int63n(int64(d)/5+1))
+}
+
+func (pp *persistentPeers) Close() {
+	pp.once.Do(func() { close(pp.quit) })
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a tokenBucket is a classic token-bucket rate limiter:
+// tokens refill at rate per second up to burst capacity, and
+// TakeOne reports whether a token was available right now.
+// It never blocks, which matters here: handleRqObject must
+// decide to serve or reject a request without allocating a
+// goroutine to wait
+type tokenBucket struct {
+	mx sync.Mutex
+
+	rate  float64 // tokens added per second
+	burst float64 // bucket capacity
+
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) (tb *tokenBucket) {
+	tb = new(tokenBucket)
+	tb.rate = rate
+	tb.burst = burst
+	tb.tokens = burst
+	tb.last = time.Now()
+	return
+}
+
+// TakeOne consumes a single token if one is available. A
+// zero-value rate (unconfigured) means "unlimited"
+func (tb *tokenBucket) TakeOne() bool {
+	if tb.rate <= 0 {
+		return true
+	}
+
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+
+	now := time.Now()
+	tb.tokens += tb.rate * now.Sub(tb.last).Seconds()
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+
+	tb.tokens--
+	return true
+}
+
+// ConnStat is a snapshot of a Conn's request-handling counters,
+// following the pattern of ethereum's dial/peer stats so
+// operators can observe throttle behavior
+type ConnStat struct {
+	RqObjectAccepted    uint64 // handled normally
+	RqObjectRateLimited uint64 // rejected: token bucket empty or outstanding-Want cap reached
+	RqObjectUnwanted    uint64 // rejected: key unreachable from any subscribed Root
+	OutstandingWants    int64  // currently-open Want subscriptions on this Conn
+}
+
+// connLimiter bundles the per-Conn rate limiter with the
+// counters exposed by Conn.Stats
+type connLimiter struct {
+	bucket *tokenBucket
+
+	maxOutstanding int64
+
+	accepted    uint64
+	rateLimited uint64
+	unwanted    uint64
+	outstanding int64
+}
+
+func newConnLimiter(rate, burst float64, maxOutstanding int) (cl *connLimiter) {
+	cl = new(connLimiter)
+	cl.bucket = newTokenBucket(rate, burst)
+	cl.maxOutstanding = int64(maxOutstanding)
+	return
+}
+
+// allow reports whether a new RqObject should be served: the
+// token bucket must have a token AND the Conn must not
+// already be holding the configured maximum of outstanding
+// Want subscriptions
+func (cl *connLimiter) allow() bool {
+	if cl.maxOutstanding > 0 && atomic.LoadInt64(&cl.outstanding) >= cl.maxOutstanding {
+		atomic.AddUint64(&cl.rateLimited, 1)
+		return false
+	}
+	if cl.bucket.TakeOne() == false {
+		atomic.AddUint64(&cl.rateLimited, 1)
+		return false
+	}
+	atomic.AddUint64(&cl.accepted, 1)
+	atomic.AddInt64(&cl.outstanding, 1)
+	return true
+}
+
+// release gives back the outstanding-Want slot taken by a
+// successful allow()
+func (cl *connLimiter) release() {
+	atomic.AddInt64(&cl.outstanding, -1)
+}
+
+// markUnwanted records an RqObject/RqObjects rejected because
+// the key isn't reachable from any Root this Conn is
+// subscribed to. Like release, it gives back the outstanding-
+// Want slot taken by the allow() that admitted the request in
+// the first place: the caller returns before ever spawning the
+// handler that would otherwise have released it
+func (cl *connLimiter) markUnwanted() {
+	atomic.AddUint64(&cl.unwanted, 1)
+	atomic.AddInt64(&cl.outstanding, -1)
+}
+
+func (cl *connLimiter) stat() (st ConnStat) {
+	st.RqObjectAccepted = atomic.LoadUint64(&cl.accepted)
+	st.RqObjectRateLimited = atomic.LoadUint64(&cl.rateLimited)
+	st.RqObjectUnwanted = atomic.LoadUint64(&cl.unwanted)
+	st.OutstandingWants = atomic.LoadInt64(&cl.outstanding)
+	return
+}
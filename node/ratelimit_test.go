@@ -0,0 +1,99 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTokenBucketBurstThenRefill checks the two contracts
+// connLimiter.allow relies on: a fresh bucket serves up to
+// burst requests back-to-back, the next one is rejected, and
+// after waiting long enough for the rate to refill a token,
+// one more request is served
+func TestTokenBucketBurstThenRefill(t *testing.T) {
+
+	tb := newTokenBucket(10, 2) // 10/s, burst of 2
+
+	if !tb.TakeOne() {
+		t.Fatal("first token of a fresh burst should be available")
+	}
+	if !tb.TakeOne() {
+		t.Fatal("second token of a fresh burst should be available")
+	}
+	if tb.TakeOne() {
+		t.Fatal("burst exhausted: third token should be rejected")
+	}
+
+	time.Sleep(150 * time.Millisecond) // ~1.5 tokens at 10/s
+
+	if !tb.TakeOne() {
+		t.Fatal("expected a token to have refilled")
+	}
+}
+
+// TestTokenBucketUnlimited checks the documented zero-rate
+// escape hatch: an unconfigured bucket never rejects
+func TestTokenBucketUnlimited(t *testing.T) {
+
+	tb := newTokenBucket(0, 0)
+
+	for i := 0; i < 1000; i++ {
+		if !tb.TakeOne() {
+			t.Fatal("a zero-rate bucket must never reject")
+		}
+	}
+}
+
+// TestConnLimiterMaxOutstanding checks that allow() also gates
+// on the configured outstanding-Want ceiling, independent of
+// the token bucket, and that release() frees a slot back up
+func TestConnLimiterMaxOutstanding(t *testing.T) {
+
+	cl := newConnLimiter(0, 0, 1) // unlimited rate, one outstanding slot
+
+	if !cl.allow() {
+		t.Fatal("first request should be allowed")
+	}
+	if cl.allow() {
+		t.Fatal("second concurrent request should be rejected: max outstanding reached")
+	}
+
+	cl.release()
+
+	if !cl.allow() {
+		t.Fatal("request should be allowed again after release")
+	}
+
+	st := cl.stat()
+	if st.RqObjectAccepted != 2 || st.RqObjectRateLimited != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+}
+
+// TestConnLimiterMarkUnwanted checks that the unwanted-key
+// branch's markUnwanted both increments RqObjectUnwanted and
+// frees the outstanding-Want slot allow() took, the same as
+// release would, since the handler that would otherwise
+// release it is never spawned
+func TestConnLimiterMarkUnwanted(t *testing.T) {
+
+	cl := newConnLimiter(0, 0, 1) // unlimited rate, one outstanding slot
+
+	if !cl.allow() {
+		t.Fatal("first request should be allowed")
+	}
+
+	cl.markUnwanted()
+
+	st := cl.stat()
+	if st.RqObjectUnwanted != 1 {
+		t.Fatalf("expected RqObjectUnwanted to increment, got %+v", st)
+	}
+	if st.OutstandingWants != 0 {
+		t.Fatalf("markUnwanted should free the outstanding slot, got %+v", st)
+	}
+
+	if !cl.allow() {
+		t.Fatal("slot freed by markUnwanted should be reusable")
+	}
+}
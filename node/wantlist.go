@@ -0,0 +1,166 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+
+	"github.com/skycoin/cxo/node/msg"
+)
+
+// a wantEntry is a single outstanding RqObject folded
+// into the Wantlist's next batch
+type wantEntry struct {
+	key   cipher.SHA256
+	reply chan<- msg.Msg // one reply per requester, even for a shared batch
+}
+
+// A Wantlist coalesces many outstanding RqObject requests
+// issued concurrently on the same Conn into a single
+// RqObjects messege, so a board with thousands of posts can
+// be fetched with one round trip instead of one per post.
+// It mirrors Bitswap's want-manager: callers add keys they
+// are interested in and the Wantlist takes care of batching
+// the wire requests. Keys are not de-duplicated: each Get
+// adds its own entry to the batch
+type Wantlist struct {
+	c *Conn
+
+	delay time.Duration // batching window
+
+	mx      sync.Mutex
+	pending []wantEntry
+	timer   *time.Timer
+}
+
+// newWantlist creates a Wantlist for given Conn. The delay
+// is how long the Wantlist waits for more Get calls to join
+// the current batch before sending it; zero means "flush on
+// the next scheduler tick" (effectively as soon as possible)
+func newWantlist(c *Conn, delay time.Duration) (w *Wantlist) {
+	w = new(Wantlist)
+	w.c = c
+	w.delay = delay
+	return
+}
+
+// Get requests a single object by key, folding it into the
+// next outgoing RqObjects batch. It blocks until the object
+// arrives, the Conn closes, or the response timeout (if any)
+// fires
+func (w *Wantlist) Get(key cipher.SHA256) (val []byte, err error) {
+
+	var reply = make(chan msg.Msg, 1)
+
+	w.mx.Lock()
+	w.pending = append(w.pending, wantEntry{key, reply})
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, w.flush)
+	}
+	w.mx.Unlock()
+
+	select {
+	case m := <-reply:
+		switch x := m.(type) {
+		case *msg.Object:
+			val = x.Value
+		case *msg.Err:
+			err = errNode(x.Err)
+		default:
+			err = ErrUnexpectedResponse
+		}
+	case <-w.c.closeq:
+		err = ErrConnClsoed
+	}
+
+	return
+}
+
+// GetMany is the same as calling Get for every key, but
+// guarantees all of them ship in the same wire batch if
+// they are requested before the batching window elapses
+func (w *Wantlist) GetMany(keys []cipher.SHA256) (vals [][]byte, errs []error) {
+
+	vals = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+
+	var wg sync.WaitGroup
+	wg.Add(len(keys))
+
+	for i, key := range keys {
+		go func(i int, key cipher.SHA256) {
+			defer wg.Done()
+			vals[i], errs[i] = w.Get(key)
+		}(i, key)
+	}
+
+	wg.Wait()
+	return
+}
+
+// flush sends out the current batch as a single RqObjects
+// messege and fans replies back to each waiting Get/GetMany
+// caller through its own reply channel. If the remote peer
+// doesn't support batching (pre-batch legacy node), flush
+// falls back to issuing individual RqObject requests
+func (w *Wantlist) flush() {
+
+	w.mx.Lock()
+	var batch = w.pending
+	w.pending = nil
+	w.timer = nil
+	w.mx.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	var keys = make([]cipher.SHA256, len(batch))
+	for i, e := range batch {
+		keys[i] = e.key
+	}
+
+	reply, err := w.c.sendRequest(&msg.RqObjects{Keys: keys})
+	if err != nil {
+		for _, e := range batch {
+			e.reply <- &msg.Err{Err: err.Error()}
+		}
+		return
+	}
+
+	objs, ok := reply.(*msg.Objects)
+	if ok == false || len(objs.Values) != len(batch) {
+		// legacy peer or malformed reply: fall back to the
+		// single-object path for every key in the batch
+		for _, e := range batch {
+			go w.c.fetchOne(e)
+		}
+		return
+	}
+
+	for i, e := range batch {
+		if objs.Values[i] == nil {
+			e.reply <- &msg.Err{Err: "not found"}
+			continue
+		}
+		e.reply <- &msg.Object{Value: objs.Values[i]}
+	}
+}
+
+// fetchOne issues a plain RqObject for a single entry,
+// used as the backward-compat fallback when a peer does
+// not understand RqObjects
+func (c *Conn) fetchOne(e wantEntry) {
+	reply, err := c.sendRequest(&msg.RqObject{Key: e.key})
+	if err != nil {
+		e.reply <- &msg.Err{Err: err.Error()}
+		return
+	}
+	e.reply <- reply
+}
+
+// errNode wraps a remote Err messege's text as a local error
+type errNode string
+
+func (e errNode) Error() string { return string(e) }
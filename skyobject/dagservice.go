@@ -0,0 +1,115 @@
+package skyobject
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// A Getter gets an encoded object by its hash, e.g. from a
+// local database or from a remote peer; node.Wantlist
+// satisfies it
+type Getter interface {
+	Get(key cipher.SHA256) (val []byte, err error)
+}
+
+// A NodeOption is one reply of a batched DAGService.GetMany
+// call. Exactly one NodeOption is sent per requested key,
+// in no particular order, so callers should key results by
+// Node.Key rather than relying on request order
+type NodeOption struct {
+	Key  cipher.SHA256
+	Node []byte // encoded object, nil if Err is set
+	Err  error
+}
+
+// A DAGService fetches content-addressed objects, possibly
+// batching many outstanding requests for the same remote
+// peer into a single wire round trip (modeled on IPFS's
+// dagService.GetMany). It lets callers like
+// BBSIndexer.GetThreadsFromBoard pull all children of a
+// node concurrently instead of walking them one at a time
+type DAGService struct {
+	get Getter
+
+	mx      sync.Mutex
+	pending map[cipher.SHA256][]waiter // in-flight fan-out
+}
+
+// a waiter is one GetMany call's interest in a single key;
+// done is called exactly once the key has been delivered to
+// ch, so the call can tell when its whole batch is complete
+// even though some keys may be satisfied by another call's
+// in-flight fetch
+type waiter struct {
+	ch   chan<- NodeOption
+	done func()
+}
+
+// NewDAGService creates a DAGService that fetches missing
+// objects through given Getter
+func NewDAGService(get Getter) (ds *DAGService) {
+	ds = new(DAGService)
+	ds.get = get
+	ds.pending = make(map[cipher.SHA256][]waiter)
+	return
+}
+
+// GetMany fetches all given keys, deduplicating concurrent
+// requests for the same key, and streams results back as
+// they arrive. The returned channel is closed once every
+// key has been answered
+func (ds *DAGService) GetMany(keys []cipher.SHA256) <-chan NodeOption {
+
+	var out = make(chan NodeOption, len(keys))
+
+	if len(keys) == 0 {
+		close(out)
+		return out
+	}
+
+	var remaining = int64(len(keys))
+	var done = func() {
+		if atomic.AddInt64(&remaining, -1) == 0 {
+			close(out)
+		}
+	}
+
+	var fetch = make([]cipher.SHA256, 0, len(keys))
+
+	ds.mx.Lock()
+	for _, key := range keys {
+		w := waiter{out, done}
+		if _, already := ds.pending[key]; already {
+			ds.pending[key] = append(ds.pending[key], w)
+			continue
+		}
+		ds.pending[key] = []waiter{w}
+		fetch = append(fetch, key)
+	}
+	ds.mx.Unlock()
+
+	for _, key := range fetch {
+		go func(key cipher.SHA256) {
+			val, err := ds.get.Get(key)
+			ds.deliver(NodeOption{Key: key, Node: val, Err: err})
+		}(key)
+	}
+
+	return out
+}
+
+// deliver fans a single result out to every caller that is
+// waiting on this key, then forgets the key
+func (ds *DAGService) deliver(no NodeOption) {
+	ds.mx.Lock()
+	waiters := ds.pending[no.Key]
+	delete(ds.pending, no.Key)
+	ds.mx.Unlock()
+
+	for _, w := range waiters {
+		w.ch <- no
+		w.done()
+	}
+}
@@ -0,0 +1,14 @@
+package skyobject
+
+// A Stat is a snapshot of Container-level statistics: how
+// effective the content-addressed cache is and how much fill
+// work is in flight. It's returned by Container.Stat and
+// composed into the CXO field of node.Stat by Node.Stat
+type Stat struct {
+	CacheHits   uint64 // objects served from the in-memory cache
+	CacheMisses uint64 // objects that required a DAGService fetch
+
+	FillsInFlight int // Root fills currently running
+
+	HeldRoots int // Root objects currently referenced from the cache
+}